@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type authContextKey struct{}
+
+type authInfo struct {
+	userID uuid.UUID
+	role   string
+}
+
+// authenticate validates the request's bearer JWT, responding with a 401 and
+// returning false if it's missing or invalid
+func (cfg *apiConfig) authenticate(w http.ResponseWriter, r *http.Request) (uuid.UUID, string, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, "", false
+	}
+	userID, role, err := auth.ValidateJWT(token, cfg.jwtSecret, cfg.jwtIssuer, cfg.jwtAudience, cfg.db)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidToken, "Couldn't validate JWT", err)
+		return uuid.Nil, "", false
+	}
+	logUserID(w, userID)
+	return userID, role, true
+}
+
+// requireAuth only lets through requests with a valid JWT, leaving the
+// caller's ID and role in the request context for userIDFromContext and
+// roleFromContext
+func (cfg *apiConfig) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, role, ok := cfg.authenticate(w, r)
+		if !ok {
+			return
+		}
+		ctx := context.WithValue(r.Context(), authContextKey{}, authInfo{userID: userID, role: role})
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// requireAdmin is requireAuth for routes only admins may use
+func (cfg *apiConfig) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return cfg.requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if roleFromContext(r) != auth.RoleAdmin {
+			respondWithError(w, http.StatusForbidden, "Only admins can do that", nil)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// userIDFromContext returns the caller's ID for a route behind requireAuth
+func userIDFromContext(r *http.Request) uuid.UUID {
+	info, _ := r.Context().Value(authContextKey{}).(authInfo)
+	return info.userID
+}
+
+// roleFromContext returns the caller's role for a route behind requireAuth
+func roleFromContext(r *http.Request) string {
+	info, _ := r.Context().Value(authContextKey{}).(authInfo)
+	return info.role
+}
+
+// requireOwnerOrAdmin reports whether the caller may manage a resource owned
+// by ownerID
+func requireOwnerOrAdmin(ownerID, userID uuid.UUID, role string) bool {
+	return ownerID == userID || role == auth.RoleAdmin
+}
+
+// ownerOnly reports whether only the video's owner and admins may watch it,
+// whatever links to it are out there
+func ownerOnly(video database.Video) bool {
+	return video.Visibility == database.VisibilityPrivate || video.ProcessingStatus == database.VideoStatusUnderReview
+}
+
+// getOwnedVideo loads the video named in the path for its owner or an admin,
+// responding with an error and returning false otherwise
+func (cfg *apiConfig) getOwnedVideo(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return database.Video{}, false
+	}
+
+	userID := userIDFromContext(r)
+	role := roleFromContext(r)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil || !requireOwnerOrAdmin(video.UserID, userID, role) || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
@@ -130,7 +130,7 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/thumbnail_upload/${videoID}`, {
+    const res = await fetch(`/api/videos/${videoID}/thumbnail`, {
       method: 'POST',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
@@ -175,7 +175,8 @@ async function uploadVideoFile(videoID) {
       throw new Error(`Failed to upload video file. Error: ${data.error}`);
     }
 
-    console.log('Video uploaded!');
+    console.log('Video uploaded, processing...');
+    await waitForProcessing(videoID);
     await getVideo(videoID);
   } catch (error) {
     alert(`Error: ${error.message}`);
@@ -188,7 +189,7 @@ const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
   try {
-    const res = await fetch('/api/videos', {
+    const res = await fetch('/api/videos?limit=100', {
       method: 'GET',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
@@ -248,6 +249,29 @@ async function getVideo(videoID) {
   }
 }
 
+async function waitForProcessing(videoID) {
+  for (;;) {
+    const res = await fetch(`/api/videos/${videoID}`, {
+      method: 'GET',
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+    if (!res.ok) {
+      throw new Error('Failed to get video.');
+    }
+
+    const video = await res.json();
+    if (video.processing_status === 'failed') {
+      throw new Error(`Failed to process video. Error: ${video.processing_error}`);
+    }
+    if (video.processing_status !== 'processing') {
+      return;
+    }
+    await new Promise((resolve) => setTimeout(resolve, 2000));
+  }
+}
+
 let currentVideo = null;
 
 function viewVideo(video) {
@@ -10,3 +10,19 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// ensureTempDir creates the temp directory if it's missing and checks that
+// files can be written to it, so a bad mount fails at startup rather than on
+// the first upload
+func (cfg apiConfig) ensureTempDir() error {
+	err := os.MkdirAll(cfg.tempDir, 0o700)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(cfg.tempDir, "tubely-check-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
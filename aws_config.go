@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// awsCredentialOptions picks where S3 credentials come from. With everything
+// empty the SDK's default chain is used: environment variables, the shared
+// config and credentials files, then the container or instance role.
+type awsCredentialOptions struct {
+	// profile is a named profile from the shared config files
+	profile string
+	// roleARN, when set, is assumed through STS with the base credentials,
+	// for buckets that live in another account
+	roleARN     string
+	externalID  string
+	sessionName string
+}
+
+func loadAWSConfig(ctx context.Context, region string, opts awsCredentialOptions) (aws.Config, error) {
+	loadOptions := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if opts.profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(opts.profile))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if opts.roleARN == "" {
+		return awsConfig, nil
+	}
+
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsConfig), opts.roleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = opts.sessionName
+		if opts.externalID != "" {
+			o.ExternalID = aws.String(opts.externalID)
+		}
+	})
+	// the cache refreshes the role's temporary credentials before they expire
+	awsConfig.Credentials = aws.NewCredentialsCache(provider)
+	return awsConfig, nil
+}
@@ -1,6 +1,18 @@
 package main
 
-import "net/http"
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
 
 func noCacheMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -8,3 +20,115 @@ func noCacheMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// videoETag hashes the video before its URLs are signed, since signing
+// produces different URLs every time. With signed URLs the tag also rolls
+// over every half expiry, so a cached response never holds expired URLs.
+func (cfg *apiConfig) videoETag(video database.Video) (string, error) {
+	dat, err := json.Marshal(video)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write(dat)
+	if window := cfg.signedURLExpiry / 2; cfg.cfSigner != nil && window > 0 {
+		fmt.Fprintf(hash, "\n%d", time.Now().UnixNano()/int64(window))
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`, nil
+}
+
+// etagMatches reports whether the request's If-None-Match lists etag
+func etagMatches(r *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// signedURLCache remembers recently signed URLs so videos that are watched
+// over and over aren't signed again on every request. It holds at most
+// size entries, evicting the least recently used. A nil cache stores
+// nothing.
+type signedURLCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	// order has the most recently used entry at the front
+	order *list.List
+}
+
+type signedURLEntry struct {
+	url        string
+	signedURL  string
+	expiresAt  time.Time
+	reuseUntil time.Time
+}
+
+func newSignedURLCache(size int) *signedURLCache {
+	return &signedURLCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+func (c *signedURLCache) get(url string, now time.Time) (string, time.Time, bool) {
+	if c == nil {
+		return "", time.Time{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[url]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	entry := element.Value.(signedURLEntry)
+	if !now.Before(entry.reuseUntil) {
+		c.order.Remove(element)
+		delete(c.entries, url)
+		return "", time.Time{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry.signedURL, entry.expiresAt, true
+}
+
+// put caches signedURL for url, to be handed out again until reuseUntil
+func (c *signedURLCache) put(url, signedURL string, expiresAt, reuseUntil time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := signedURLEntry{url: url, signedURL: signedURL, expiresAt: expiresAt, reuseUntil: reuseUntil}
+	if element, ok := c.entries[url]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[url] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(signedURLEntry).url)
+	}
+}
+
+// invalidate drops url so a deleted object stops being handed out. Replaced
+// files get new keys, and so new URLs, without it.
+func (c *signedURLCache) invalidate(url string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[url]; ok {
+		c.order.Remove(element)
+		delete(c.entries, url)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// codecAllowlist lists the codecs, as ffprobe names them, that a stored
+// video may use. Anything else is re-encoded to H.264/AAC, or rejected in
+// strict mode.
+type codecAllowlist struct {
+	video []string
+	audio []string
+}
+
+func parseCodecList(s string) []string {
+	codecs := []string{}
+	for _, codec := range strings.Split(s, ",") {
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		if codec != "" {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+// disallowedCodec returns the first codec in metadata that isn't allowed, or
+// an empty string if they all are
+func (a codecAllowlist) disallowedCodec(metadata videoMetadata) string {
+	if !slices.Contains(a.video, metadata.Codec) {
+		return metadata.Codec
+	}
+	if metadata.HasAudio && !slices.Contains(a.audio, metadata.AudioCodec) {
+		return metadata.AudioCodec
+	}
+	return ""
+}
+
+func (a codecAllowlist) allows(metadata videoMetadata) bool {
+	return a.disallowedCodec(metadata) == ""
+}
+
+// codecError explains why a video was rejected in strict mode
+func (a codecAllowlist) codecError(codec string) string {
+	return fmt.Sprintf("Codec %s isn't allowed, expected video in %s and audio in %s",
+		codec, strings.Join(a.video, ", "), strings.Join(a.audio, ", "))
+}
+
+// requireAcceptedVideo probes the raw upload at path, before any of the
+// expensive processing, and responds with a 400 and returns false if it's
+// longer than the maximum duration or, in strict mode, in a codec that
+// isn't allowed. Outside strict mode the pipeline re-encodes instead.
+func (cfg *apiConfig) requireAcceptedVideo(w http.ResponseWriter, ctx context.Context, path string) bool {
+	if !cfg.strictCodecs && cfg.maxDuration == 0 {
+		return true
+	}
+
+	metadata, err := getVideoMetadata(ctx, path)
+	if err != nil {
+		cfg.metrics.uploadFailed("invalid_format")
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Couldn't read the video's metadata", err)
+		return false
+	}
+	if message := cfg.durationError(metadata); message != "" {
+		cfg.metrics.uploadFailed("too_long")
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeTooLong, message, nil)
+		return false
+	}
+	if codec := cfg.codecs.disallowedCodec(metadata); cfg.strictCodecs && codec != "" {
+		cfg.metrics.uploadFailed("invalid_codec")
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedCodec, cfg.codecs.codecError(codec), nil)
+		return false
+	}
+	return true
+}
+
+// durationError explains why a video is too long, or is empty if it isn't
+// or there's no maximum
+func (cfg *apiConfig) durationError(metadata videoMetadata) string {
+	duration := time.Duration(metadata.DurationSeconds * float64(time.Second))
+	if cfg.maxDuration == 0 || duration <= cfg.maxDuration {
+		return ""
+	}
+	return fmt.Sprintf("Video is %s long, the maximum is %s", duration.Round(time.Second), cfg.maxDuration)
+}
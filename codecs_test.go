@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequireAcceptedVideoDuration(t *testing.T) {
+	tests := []struct {
+		name            string
+		durationSeconds float64
+		wantAccepted    bool
+	}{
+		{"short", 30, true},
+		{"at the limit", 3600, true},
+		{"too long", 3601, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubCommands(t, func(name string, args []string) fakeCommand {
+				return fakeCommand{stdout: probeOutput("h264", 1920, 1080, "aac", tt.durationSeconds)}
+			})
+			cfg := &apiConfig{maxDuration: time.Hour, codecs: testAllowlist}
+			w := httptest.NewRecorder()
+
+			accepted := cfg.requireAcceptedVideo(w, context.Background(), writeTestVideo(t))
+			if accepted != tt.wantAccepted {
+				t.Fatalf("requireAcceptedVideo = %v, want %v", accepted, tt.wantAccepted)
+			}
+			if !accepted && w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+		})
+	}
+}
+
+func TestRequireAcceptedVideoWithoutLimitSkipsProbe(t *testing.T) {
+	var calls invocations
+	stubCommands(t, func(name string, args []string) fakeCommand {
+		calls.record(name, args)
+		return fakeCommand{exitCode: 1}
+	})
+	cfg := &apiConfig{codecs: testAllowlist}
+
+	if !cfg.requireAcceptedVideo(httptest.NewRecorder(), context.Background(), writeTestVideo(t)) {
+		t.Fatal("requireAcceptedVideo rejected the video, want it accepted")
+	}
+	if calls.count() != 0 {
+		t.Errorf("ffprobe ran %d times, want none", calls.count())
+	}
+}
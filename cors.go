@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type corsConfig struct {
+	allowedOrigins   []string
+	allowedMethods   []string
+	allowedHeaders   []string
+	allowCredentials bool
+}
+
+// headers the frontend reads off our responses
+var corsExposedHeaders = []string{"X-Request-ID", "X-Total-Count", "Retry-After"}
+
+func (c corsConfig) originAllowed(origin string) bool {
+	return slices.Contains(c.allowedOrigins, "*") || slices.Contains(c.allowedOrigins, origin)
+}
+
+// corsMiddleware answers preflight requests itself, since the mux only
+// routes the methods each handler registered for
+func corsMiddleware(c corsConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !c.originAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		// browsers reject a wildcard origin on credentialed requests
+		if slices.Contains(c.allowedOrigins, "*") && !c.allowCredentials {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.allowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.allowedMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.allowedHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// splitList parses a comma separated env value, ignoring empty entries
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// emailSender delivers plain text email, such as verification links
+type emailSender interface {
+	SendEmail(ctx context.Context, to, subject, body string) error
+}
+
+// smtpEmailSender sends through an SMTP relay, authenticating when a
+// username is set
+type smtpEmailSender struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+func (s smtpEmailSender) SendEmail(ctx context.Context, to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("email headers can't contain line breaks")
+	}
+
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, err := net.SplitHostPort(s.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+
+	message := "From: " + s.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		body
+	return smtp.SendMail(s.addr, auth, s.from, []string{to}, []byte(message))
+}
+
+// logEmailSender writes email to the log instead of sending it, for local
+// development without an SMTP relay
+type logEmailSender struct{}
+
+func (logEmailSender) SendEmail(ctx context.Context, to, subject, body string) error {
+	slog.InfoContext(ctx, "Email not sent, SMTP isn't configured", "to", to, "subject", subject, "body", body)
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// isFastStart reports whether the MP4 at path has its moov atom ahead of
+// mdat, so players can start before the whole file has downloaded. Files
+// that can't be read or parsed are reported as not faststart, which only
+// costs an unneeded ffmpeg pass.
+func isFastStart(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, 16)
+	var offset int64
+	for {
+		_, err := file.ReadAt(header[:8], offset)
+		if err != nil {
+			return false
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		atomType := string(header[4:8])
+
+		switch atomType {
+		case "moov":
+			return true
+		case "mdat":
+			return false
+		}
+
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// the atom runs to the end of the file
+			return false
+		case 1:
+			// a 64-bit size follows the type
+			_, err := file.ReadAt(header[8:16], offset+8)
+			if err != nil {
+				return false
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize {
+			return false
+		}
+		offset += size
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// atom is an MP4 box with a 32-bit size
+func atom(atomType string, payload []byte) []byte {
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	return append(append(box, atomType...), payload...)
+}
+
+// largeAtom is an MP4 box with a 64-bit size
+func largeAtom(atomType string, payload []byte) []byte {
+	box := binary.BigEndian.AppendUint32(nil, 1)
+	box = append(box, atomType...)
+	box = binary.BigEndian.AppendUint64(box, uint64(16+len(payload)))
+	return append(box, payload...)
+}
+
+func TestIsFastStart(t *testing.T) {
+	ftyp := atom("ftyp", []byte("isom\x00\x00\x02\x00isomiso2avc1mp41"))
+	moov := atom("moov", atom("mvhd", make([]byte, 100)))
+	mdat := atom("mdat", make([]byte, 1000))
+
+	tests := []struct {
+		name  string
+		atoms [][]byte
+		want  bool
+	}{
+		{"moov first", [][]byte{ftyp, moov, mdat}, true},
+		{"mdat first", [][]byte{ftyp, mdat, moov}, false},
+		{"free atom before moov", [][]byte{ftyp, atom("free", make([]byte, 8)), moov, mdat}, true},
+		{"64-bit size before moov", [][]byte{ftyp, largeAtom("free", make([]byte, 8)), moov, mdat}, true},
+		{"64-bit mdat first", [][]byte{ftyp, largeAtom("mdat", make([]byte, 1000)), moov}, false},
+		{"no moov", [][]byte{ftyp}, false},
+		{"atom to the end of the file", [][]byte{ftyp, {0, 0, 0, 0, 'u', 'u', 'i', 'd'}}, false},
+		{"truncated", [][]byte{ftyp[:6]}, false},
+		{"size smaller than its header", [][]byte{{0, 0, 0, 4, 'f', 'r', 'e', 'e'}, moov}, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "video.mp4")
+			err := os.WriteFile(path, bytes.Join(tt.atoms, nil), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := isFastStart(path); got != tt.want {
+				t.Errorf("isFastStart = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsFastStartMissingFile(t *testing.T) {
+	if isFastStart(filepath.Join(t.TempDir(), "missing.mp4")) {
+		t.Error("isFastStart = true for a missing file, want false")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// execCommand starts ffmpeg and ffprobe. Tests swap it for a stand-in.
+var execCommand = exec.CommandContext
+
+// maxFFmpegRetries bounds FFMPEG_RETRIES, since each retry can hold an
+// ffmpeg slot for the length of a whole encode
+const maxFFmpegRetries = 10
+
+// transientFFmpegErrors are what ffmpeg prints when it failed for want of a
+// resource rather than because of the input, so another attempt may work
+var transientFFmpegErrors = []string{
+	"Resource temporarily unavailable",
+	"Device or resource busy",
+	"Text file busy",
+	"Cannot allocate memory",
+	"Interrupted system call",
+}
+
+// isTransientFFmpegError reports whether a failed ffmpeg run is worth
+// retrying. Anything not known to be transient, like invalid input, isn't.
+func isTransientFFmpegError(err error, stderr string) bool {
+	var exitErr *exec.ExitError
+	// killed by a signal we didn't send, e.g. the OOM killer
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == -1 {
+		return true
+	}
+	for _, message := range transientFFmpegErrors {
+		if strings.Contains(stderr, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// runFFmpeg runs ffmpeg with args, which write to outputPath, trying up to
+// retries more times when it fails transiently. The partial output is
+// removed after every failure.
+func runFFmpeg(ctx context.Context, retries int, outputPath string, args ...string) error {
+	for attempt := 0; ; attempt++ {
+		var stderr bytes.Buffer
+		command := execCommand(ctx, "ffmpeg", args...)
+		command.Stderr = &stderr
+		slog.DebugContext(ctx, "Running ffmpeg", "command", command.String(), "attempt", attempt+1)
+		err := command.Run()
+		if err == nil {
+			return nil
+		}
+		os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= retries || !isTransientFFmpegError(err, stderr.String()) {
+			return fmt.Errorf("%w: %s", err, lastLine(stderr.String()))
+		}
+
+		delay := retryDelay(attempt)
+		slog.WarnContext(ctx, "Retrying ffmpeg", "attempt", attempt+1, "delay", delay, "error", err, "stderr", lastLine(stderr.String()))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// lastLine is the last non-empty line of ffmpeg's output, which is usually
+// the reason it gave up
+func lastLine(output string) string {
+	lines := strings.FieldsFunc(output, func(r rune) bool { return r == '\n' || r == '\r' })
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// fakeCommand is how a stand-in ffmpeg or ffprobe run behaves
+type fakeCommand struct {
+	stdout   string
+	stderr   string
+	exitCode int
+	// sleep holds the process open, for tests that cancel it
+	sleep time.Duration
+	// output, when set, is written to outputPath
+	output     string
+	outputPath string
+	// danglingOutput writes outputPath as a symlink to nowhere instead, a
+	// file that's there but can't be opened
+	danglingOutput bool
+	// trackIn, when set, is a directory the run marks itself running in,
+	// for tests counting how many run at once
+	trackIn string
+}
+
+// stubCommands swaps execCommand for the rest of the test. run is called in
+// the test process for every invocation and decides how it behaves; the
+// command itself is this test binary running TestHelperProcess, so it's a
+// real process that can be killed.
+func stubCommands(t *testing.T, run func(name string, args []string) fakeCommand) {
+	t.Helper()
+	original := execCommand
+	t.Cleanup(func() { execCommand = original })
+
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		fake := run(name, args)
+		command := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestHelperProcess$")
+		command.Env = append(os.Environ(),
+			"TUBELY_HELPER_PROCESS=1",
+			"TUBELY_HELPER_STDOUT="+fake.stdout,
+			"TUBELY_HELPER_STDERR="+fake.stderr,
+			"TUBELY_HELPER_EXIT="+strconv.Itoa(fake.exitCode),
+			"TUBELY_HELPER_SLEEP="+fake.sleep.String(),
+			"TUBELY_HELPER_OUTPUT="+fake.output,
+			"TUBELY_HELPER_OUTPUT_PATH="+fake.outputPath,
+			"TUBELY_HELPER_DANGLING="+strconv.FormatBool(fake.danglingOutput),
+			"TUBELY_HELPER_TRACK="+fake.trackIn,
+		)
+		return command
+	}
+}
+
+// TestHelperProcess isn't a real test. It's what stubCommands runs in place
+// of ffmpeg and ffprobe.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("TUBELY_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	// os.Exit skips deferred calls, so the marker is removed by hand
+	marker := ""
+	if dir := os.Getenv("TUBELY_HELPER_TRACK"); dir != "" {
+		pid := strconv.Itoa(os.Getpid())
+		marker = filepath.Join(dir, "running", pid)
+		os.WriteFile(marker, nil, 0o600)
+		running, _ := os.ReadDir(filepath.Join(dir, "running"))
+		os.WriteFile(filepath.Join(dir, "seen", pid+"-"+strconv.Itoa(len(running))), nil, 0o600)
+	}
+
+	sleep, _ := time.ParseDuration(os.Getenv("TUBELY_HELPER_SLEEP"))
+	time.Sleep(sleep)
+
+	if path := os.Getenv("TUBELY_HELPER_OUTPUT_PATH"); path != "" {
+		if os.Getenv("TUBELY_HELPER_DANGLING") == "true" {
+			os.Symlink(path+".missing", path)
+		} else {
+			os.WriteFile(path, []byte(os.Getenv("TUBELY_HELPER_OUTPUT")), 0o600)
+		}
+	}
+	fmt.Fprint(os.Stdout, os.Getenv("TUBELY_HELPER_STDOUT"))
+	fmt.Fprint(os.Stderr, os.Getenv("TUBELY_HELPER_STDERR"))
+	if marker != "" {
+		os.Remove(marker)
+	}
+	exitCode, _ := strconv.Atoi(os.Getenv("TUBELY_HELPER_EXIT"))
+	os.Exit(exitCode)
+}
+
+// invocations counts the commands a stub has been asked to run
+type invocations struct {
+	mu    sync.Mutex
+	calls [][]string
+}
+
+func (i *invocations) record(name string, args []string) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.calls = append(i.calls, append([]string{name}, args...))
+	return len(i.calls)
+}
+
+func (i *invocations) count() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.calls)
+}
+
+func TestRunFFmpegRetriesTransientFailure(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "out.mp4")
+	var calls invocations
+	stubCommands(t, func(name string, args []string) fakeCommand {
+		if calls.record(name, args) == 1 {
+			return fakeCommand{stderr: "out.mp4: Resource temporarily unavailable\n", exitCode: 1}
+		}
+		return fakeCommand{output: "video", outputPath: outputPath}
+	})
+
+	err := runFFmpeg(context.Background(), 2, outputPath, "-i", "in.mp4", outputPath)
+	if err != nil {
+		t.Fatalf("runFFmpeg: %v", err)
+	}
+	if calls.count() != 2 {
+		t.Errorf("ffmpeg ran %d times, want 2", calls.count())
+	}
+	data, err := os.ReadFile(outputPath)
+	if err != nil || string(data) != "video" {
+		t.Errorf("output = %q, %v, want the second attempt's output", data, err)
+	}
+}
+
+func TestRunFFmpegFailsFastOnInvalidInput(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "out.mp4")
+	var calls invocations
+	stubCommands(t, func(name string, args []string) fakeCommand {
+		calls.record(name, args)
+		return fakeCommand{stderr: "in.mp4: Invalid data found when processing input\n", exitCode: 1}
+	})
+
+	err := runFFmpeg(context.Background(), 2, outputPath, "-i", "in.mp4", outputPath)
+	if err == nil || !strings.Contains(err.Error(), "Invalid data found") {
+		t.Fatalf("runFFmpeg error = %v, want ffmpeg's reason", err)
+	}
+	if calls.count() != 1 {
+		t.Errorf("ffmpeg ran %d times, want 1", calls.count())
+	}
+}
+
+func TestRunFFmpegGivesUpAfterRetries(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "out.mp4")
+	var calls invocations
+	stubCommands(t, func(name string, args []string) fakeCommand {
+		calls.record(name, args)
+		return fakeCommand{stderr: "Device or resource busy\n", exitCode: 1}
+	})
+
+	err := runFFmpeg(context.Background(), 1, outputPath, "-i", "in.mp4", outputPath)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("runFFmpeg error = %v, want the exit error", err)
+	}
+	if calls.count() != 2 {
+		t.Errorf("ffmpeg ran %d times, want 2", calls.count())
+	}
+	if _, err := os.Stat(outputPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial output was left behind")
+	}
+}
+
+// mostRunning returns the most runs tracked in dir that were running at once
+func mostRunning(t *testing.T, dir string) int {
+	t.Helper()
+	seen, err := os.ReadDir(filepath.Join(dir, "seen"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	most := 0
+	for _, entry := range seen {
+		_, count, _ := strings.Cut(entry.Name(), "-")
+		n, _ := strconv.Atoi(count)
+		most = max(most, n)
+	}
+	return most
+}
+
+func TestFFmpegConcurrencyIsLimited(t *testing.T) {
+	const slots = 2
+	cfg, _ := newTestConfig(t)
+	cfg.ffmpegSem = semaphore.NewWeighted(slots)
+	trackDir := t.TempDir()
+	for _, dir := range []string{"running", "seen"} {
+		err := os.Mkdir(filepath.Join(trackDir, dir), 0o700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stubCommands(t, func(name string, args []string) fakeCommand {
+		if name == "ffprobe" {
+			return fakeCommand{stdout: probeOutput("h264", 1920, 1080, "aac", 10)}
+		}
+		return fakeCommand{output: "processed", outputPath: args[len(args)-1], sleep: 100 * time.Millisecond, trackIn: trackDir}
+	})
+
+	var wg sync.WaitGroup
+	for i := range 2 * slots {
+		video, _ := createTestVideo(t, cfg)
+		rawPath := filepath.Join(cfg.tempDir, fmt.Sprintf("tubely-upload-%d.mp4", i))
+		err := os.WriteFile(rawPath, testMP4(minUploadBytes), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cfg.processVideoUpload(context.Background(), video, rawPath, "video/mp4")
+			if err != nil {
+				t.Errorf("processVideoUpload: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if most := mostRunning(t, trackDir); most == 0 || most > slots {
+		t.Errorf("%d ffmpeg processes ran at once, want between 1 and %d", most, slots)
+	}
+}
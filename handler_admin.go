@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
+)
+
+// videoVerifyConcurrency caps the HeadObject requests a scan has in flight
+const videoVerifyConcurrency = 8
+
+// verifyVideoObject checks that a ready video's file is still in S3. A
+// missing file marks the video as missing, so clients can say so instead of
+// showing a broken player, and a missing video whose file is back is marked
+// ready again. It returns the video's status afterwards.
+func (cfg *apiConfig) verifyVideoObject(ctx context.Context, video database.Video) (string, error) {
+	key, ok := cfg.objectKeyFromURL(video.VideoURL)
+	if !ok {
+		return video.ProcessingStatus, nil
+	}
+	// moderation and processing statuses aren't ours to overwrite
+	if video.ProcessingStatus != database.VideoStatusReady && video.ProcessingStatus != database.VideoStatusMissing {
+		return video.ProcessingStatus, nil
+	}
+
+	exists, err := cfg.s3ObjectExists(ctx, cfg.videoStore(video), key)
+	if err != nil {
+		return video.ProcessingStatus, err
+	}
+
+	status := database.VideoStatusReady
+	message := ""
+	if !exists {
+		status = database.VideoStatusMissing
+		message = "Video file is missing from storage"
+	}
+	if status == video.ProcessingStatus {
+		return status, nil
+	}
+	err = cfg.db.SetVideoProcessingStatus(video.ID, status, message)
+	if err != nil {
+		return video.ProcessingStatus, err
+	}
+	return status, nil
+}
+
+// requireVideoObject responds with a 404 and returns false if the video is
+// marked missing. Its file is checked again first, in case it's been put
+// back since.
+func (cfg *apiConfig) requireVideoObject(w http.ResponseWriter, r *http.Request, video database.Video) bool {
+	if video.ProcessingStatus != database.VideoStatusMissing {
+		return true
+	}
+	status, err := cfg.verifyVideoObject(r.Context(), video)
+	if err != nil {
+		respondWithError(w, s3ErrorStatus(err), "Couldn't check video file", err)
+		return false
+	}
+	if status == database.VideoStatusMissing {
+		respondWithError(w, http.StatusNotFound, "Video file is missing from storage", nil)
+		return false
+	}
+	return true
+}
+
+// handlerAdminVerifyVideos checks every stored video's file and reports the
+// ones that are missing
+func (cfg *apiConfig) handlerAdminVerifyVideos(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Checked int         `json:"checked"`
+		Missing []uuid.UUID `json:"missing"`
+		// Restored videos were missing but their file is back
+		Restored []uuid.UUID `json:"restored"`
+		// Failed videos couldn't be checked and keep their status
+		Failed []uuid.UUID `json:"failed"`
+	}
+
+	videos, err := cfg.db.GetStoredVideosWithStatus(database.VideoStatusReady, database.VideoStatusMissing)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get videos", err)
+		return
+	}
+
+	resp := response{
+		Checked:  len(videos),
+		Missing:  []uuid.UUID{},
+		Restored: []uuid.UUID{},
+		Failed:   []uuid.UUID{},
+	}
+	var mu sync.Mutex
+	group, ctx := errgroup.WithContext(r.Context())
+	group.SetLimit(videoVerifyConcurrency)
+	for _, video := range videos {
+		group.Go(func() error {
+			status, err := cfg.verifyVideoObject(ctx, video)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				slog.ErrorContext(ctx, "Couldn't verify video object", "video_id", video.ID, "error", err)
+				resp.Failed = append(resp.Failed, video.ID)
+			case status == database.VideoStatusMissing:
+				resp.Missing = append(resp.Missing, video.ID)
+			case video.ProcessingStatus == database.VideoStatusMissing:
+				resp.Restored = append(resp.Restored, video.ID)
+			}
+			return nil
+		})
+	}
+	group.Wait()
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerAdminVideosList lists every user's videos for support staff, newest
+// first, optionally filtered by ?owner=, ?status= and ?visibility=
+func (cfg *apiConfig) handlerAdminVideosList(w http.ResponseWriter, r *http.Request) {
+	type adminVideo struct {
+		listedVideo
+		OwnerEmail string `json:"owner_email"`
+	}
+
+	limit, offset, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	params := database.GetAllVideosParams{
+		ProcessingStatus: r.URL.Query().Get("status"),
+		Visibility:       r.URL.Query().Get("visibility"),
+		IncludeDeleted:   r.URL.Query().Get("include_deleted") == "true",
+		Limit:            limit,
+		Offset:           offset,
+	}
+	if owner := r.URL.Query().Get("owner"); owner != "" {
+		ownerID, err := uuid.Parse(owner)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid owner ID", err)
+			return
+		}
+		params.UserID = ownerID
+	}
+	if params.ProcessingStatus != "" && !database.ValidProcessingStatus(params.ProcessingStatus) {
+		respondWithError(w, http.StatusBadRequest, "Invalid status", nil)
+		return
+	}
+	if params.Visibility != "" && !database.ValidVisibility(params.Visibility) {
+		respondWithError(w, http.StatusBadRequest, "Visibility must be public, unlisted or private", nil)
+		return
+	}
+
+	owned, total, err := cfg.db.GetAllVideos(params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	videos := make([]database.Video, len(owned))
+	for i, video := range owned {
+		videos[i] = video.Video
+	}
+	listed := cfg.dbVideosToSignedVideos(videos)
+	response := make([]adminVideo, len(owned))
+	for i := range owned {
+		response[i] = adminVideo{listedVideo: listed[i], OwnerEmail: owned[i].OwnerEmail}
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	respondWithJSON(w, http.StatusOK, response)
+}
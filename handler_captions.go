@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const maxCaptionBytes = 1 << 20
+
+// languagePattern accepts BCP 47 style tags like "en" or "pt-BR"
+var languagePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+func (cfg *apiConfig) captionKey(video database.Video, language string) string {
+	return fmt.Sprintf("%scaptions/%s/%s.vtt", cfg.keyPrefix, video.ID, language)
+}
+
+func (cfg *apiConfig) handlerUploadCaptions(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCaptionBytes+1<<10)
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	file, header, err := r.FormFile("captions")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Captions exceed the maximum size of %s", formatBytes(maxCaptionBytes)), err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't get captions file", err)
+		return
+	}
+	defer file.Close()
+
+	language := r.FormValue("language")
+	if !languagePattern.MatchString(language) {
+		respondWithError(w, http.StatusBadRequest, "Invalid language code", nil)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/vtt" {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Captions must be a text/vtt file", err)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, maxCaptionBytes+1))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read captions file", err)
+		return
+	}
+	if len(data) > maxCaptionBytes {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Captions exceed the maximum size of %s", formatBytes(maxCaptionBytes)), nil)
+		return
+	}
+	if !isWebVTT(data) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Captions file is missing the WEBVTT header", nil)
+		return
+	}
+
+	store := cfg.videoStore(video)
+	key := cfg.captionKey(video, language)
+	err = cfg.uploadToS3Multipart(r.Context(), store, key, bytes.NewReader(data), "text/vtt", cfg.videoStorageClass(video))
+	if err != nil {
+		respondWithError(w, s3ErrorStatus(err), "Couldn't upload captions to S3", err)
+		return
+	}
+
+	err = cfg.db.SetVideoCaption(video.ID, language, store.distribution+key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	video, err = cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// isWebVTT checks for the signature the spec requires at the start of the
+// file: an optional BOM, "WEBVTT", then a space, tab or line break
+func isWebVTT(data []byte) bool {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	rest, ok := bytes.CutPrefix(data, []byte("WEBVTT"))
+	if !ok {
+		return false
+	}
+	return len(rest) == 0 || rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\n' || rest[0] == '\r'
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerSendVerificationEmail emails the caller a link that verifies their
+// address. Earlier links keep working until they expire.
+func (cfg *apiConfig) handlerSendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r)
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, "User no longer exists", nil)
+		return
+	}
+	if user.EmailVerified {
+		respondWithError(w, http.StatusConflict, "Email is already verified", nil)
+		return
+	}
+
+	verificationToken, err := auth.MakeEmailVerificationToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create verification token", err)
+		return
+	}
+	err = cfg.db.CreateEmailVerificationToken(database.CreateEmailVerificationTokenParams{
+		Token:     verificationToken,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().UTC().Add(cfg.emailTokenExpiry),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save verification token", err)
+		return
+	}
+
+	link := cfg.publicURL + "/api/verify-email/" + verificationToken
+	err = cfg.emailSender.SendEmail(r.Context(), user.Email, "Verify your Tubely email",
+		"Follow this link to verify your email address:\n\n"+link+"\n\nThe link expires in "+cfg.emailTokenExpiry.String()+".\n")
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't send verification email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.db.VerifyEmail(r.PathValue("token"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email", err)
+		return
+	}
+	if userID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidToken, "Verification link is invalid or has expired", nil)
+		return
+	}
+	logUserID(w, userID)
+
+	type response struct {
+		EmailVerified bool `json:"email_verified"`
+	}
+	respondWithJSON(w, http.StatusOK, response{EmailVerified: true})
+}
+
+// requireVerifiedEmail responds with a 403 and returns false unless the user
+// has verified their email
+func (cfg *apiConfig) requireVerifiedEmail(w http.ResponseWriter, userID uuid.UUID) bool {
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return false
+	}
+	if user == nil || !user.EmailVerified {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeEmailNotVerified, "Verify your email before uploading videos", nil)
+		return false
+	}
+	return true
+}
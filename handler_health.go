@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// keep probes fast even when a dependency hangs
+const readinessTimeout = 2 * time.Second
+
+type healthResponse struct {
+	Status   string `json:"status"`
+	Database string `json:"database,omitempty"`
+	Storage  string `json:"storage,omitempty"`
+}
+
+// handlerHealthz only reports that the process is up and serving
+func (cfg *apiConfig) handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// handlerReadyz checks that the database and bucket are reachable, so the
+// load balancer stops routing here when either isn't
+func (cfg *apiConfig) handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	resp := healthResponse{
+		Status:   "ok",
+		Database: "ok",
+		Storage:  "ok",
+	}
+	status := http.StatusOK
+
+	err := cfg.db.Ping(ctx)
+	if err != nil {
+		resp.Status = "unavailable"
+		resp.Database = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+
+	for _, store := range cfg.s3Stores {
+		_, err = store.client.HeadBucket(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(store.bucket),
+		})
+		if err != nil {
+			resp.Status = "unavailable"
+			resp.Storage = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	respondWithJSON(w, status, resp)
+}
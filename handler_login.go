@@ -16,8 +16,9 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	type response struct {
 		database.User
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
+		Token          string    `json:"token"`
+		TokenExpiresAt time.Time `json:"token_expires_at"`
+		RefreshToken   string    `json:"refresh_token"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -30,20 +31,24 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 
 	user, err := cfg.db.GetUserByEmail(params.Email)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidCredentials, "Incorrect email or password", err)
 		return
 	}
 
 	err = auth.CheckPasswordHash(params.Password, user.Password)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidCredentials, "Incorrect email or password", err)
 		return
 	}
 
+	tokenExpiresAt := time.Now().UTC().Add(cfg.jwtExpiry)
 	accessToken, err := auth.MakeJWT(
 		user.ID,
+		user.Role,
 		cfg.jwtSecret,
-		time.Hour*24*30,
+		cfg.jwtIssuer,
+		cfg.jwtAudience,
+		cfg.jwtExpiry,
 	)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
@@ -67,8 +72,9 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		User:         user,
-		Token:        accessToken,
-		RefreshToken: refreshToken,
+		User:           user,
+		Token:          accessToken,
+		TokenExpiresAt: tokenExpiresAt,
+		RefreshToken:   refreshToken,
 	})
 }
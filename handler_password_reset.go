@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerPasswordResetRequest emails a reset token to the account's address.
+// It responds the same way whether or not the account exists, so it can't be
+// used to discover registered emails.
+func (cfg *apiConfig) handlerPasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "Email is required", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUserByEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user.ID == uuid.Nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	logUserID(w, user.ID)
+
+	resetToken, err := auth.MakePasswordResetToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create reset token", err)
+		return
+	}
+	err = cfg.db.CreatePasswordResetToken(database.CreatePasswordResetTokenParams{
+		Token:     resetToken,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().UTC().Add(cfg.resetTokenExpiry),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save reset token", err)
+		return
+	}
+
+	err = cfg.emailSender.SendEmail(r.Context(), user.Email, "Reset your Tubely password",
+		"Use this code to reset your password:\n\n"+resetToken+"\n\nThe code expires in "+cfg.resetTokenExpiry.String()+". If you didn't ask to reset your password, you can ignore this email.\n")
+	if err != nil {
+		// failing loudly would reveal that the account exists
+		slog.ErrorContext(r.Context(), "Couldn't send password reset email", "user_id", user.ID, "error", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Token == "" || params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Token and password are required", nil)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+		return
+	}
+
+	userID, err := cfg.db.ResetPassword(params.Token, hashedPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reset password", err)
+		return
+	}
+	if userID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidToken, "Reset token is invalid or has expired", nil)
+		return
+	}
+	logUserID(w, userID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
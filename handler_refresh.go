@@ -9,7 +9,8 @@ import (
 
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token          string    `json:"token"`
+		TokenExpiresAt time.Time `json:"token_expires_at"`
 	}
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
@@ -18,24 +19,51 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	storedToken, err := cfg.db.GetRefreshToken(refreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get refresh token", err)
+		return
+	}
+	if storedToken.Token == "" {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidToken, "Invalid refresh token", nil)
+		return
+	}
+	if storedToken.RevokedAt != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidToken, "Refresh token has been revoked", nil)
+		return
+	}
+	if time.Now().UTC().After(storedToken.ExpiresAt) {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidToken, "Refresh token has expired", nil)
+		return
+	}
+
 	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
 		return
 	}
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", nil)
+		return
+	}
 
+	tokenExpiresAt := time.Now().UTC().Add(cfg.refreshedExpiry)
 	accessToken, err := auth.MakeJWT(
 		user.ID,
+		user.Role,
 		cfg.jwtSecret,
-		time.Hour,
+		cfg.jwtIssuer,
+		cfg.jwtAudience,
+		cfg.refreshedExpiry,
 	)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeInvalidToken, "Couldn't validate token", err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		Token: accessToken,
+		Token:          accessToken,
+		TokenExpiresAt: tokenExpiresAt,
 	})
 }
 
@@ -54,3 +82,26 @@ func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (cfg *apiConfig) handlerLogout(w http.ResponseWriter, r *http.Request) {
+	// requireAuth has already validated the token
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	jti, expiresAt, err := auth.GetJWTID(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Token can't be revoked", err)
+		return
+	}
+
+	err = cfg.db.RevokeJWT(jti, expiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke token", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
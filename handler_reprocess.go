@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerVideoReprocess rewrites a video uploaded before faststart processing
+// so its moov atom is at the front. Videos already marked as faststart are
+// returned unchanged, so repeating the request is safe.
+func (cfg *apiConfig) handlerVideoReprocess(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	// concurrent requests for the same video wait and then see the flag
+	unlock := cfg.reprocessLocks.lock(video.ID.String())
+	defer unlock()
+
+	video, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	if video.ProcessingStatus == database.VideoStatusPending || video.ProcessingStatus == database.VideoStatusProcessing {
+		respondWithErrorCode(w, http.StatusConflict, errCodeStillProcessing, "Video is still processing", nil)
+		return
+	}
+
+	if !video.FastStart {
+		video, err = cfg.reprocessFastStart(r.Context(), video)
+		if errors.Is(err, context.DeadlineExceeded) {
+			respondWithError(w, http.StatusGatewayTimeout, "Video processing timed out", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't reprocess video", err)
+			return
+		}
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// reprocessFastStart downloads the stored video, runs it through faststart
+// and stores the result under its new content hash. Renditions are copied
+// along since their keys are derived from the video's.
+func (cfg *apiConfig) reprocessFastStart(ctx context.Context, video database.Video) (database.Video, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.processTimeout)
+	defer cancel()
+
+	store := cfg.videoStore(video)
+	videoKey, ok := cfg.objectKeyFromURL(video.VideoURL)
+	if !ok {
+		return video, errors.New("video isn't stored in the bucket")
+	}
+
+	tempFile, err := os.CreateTemp(cfg.tempDir, "tubely-reprocess-*.mp4")
+	if err != nil {
+		return video, err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	// the downloader writes parts straight to the file as they arrive
+	err = cfg.downloadS3Object(ctx, store, videoKey, tempFile)
+	if err != nil {
+		return video, err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return video, err
+	}
+
+	// files that were already faststart only need the flag set
+	if isFastStart(tempFile.Name()) {
+		contentHash, err := hashFile(tempFile.Name())
+		if err != nil {
+			return video, err
+		}
+		current, err := cfg.db.GetVideo(video.ID)
+		if err != nil {
+			return video, err
+		}
+		current.FastStart = true
+		current.ChecksumSHA256 = contentHash
+		err = cfg.db.UpdateVideo(current)
+		if err != nil {
+			return video, err
+		}
+		return current, nil
+	}
+
+	release, err := cfg.acquireFFmpeg(ctx)
+	if err != nil {
+		return video, err
+	}
+	start := time.Now()
+	processedFilePath, err := processVideoForFastStart(ctx, tempFile.Name(), cfg.codecs, cfg.ffmpegRetries)
+	release()
+	cfg.metrics.observeFFmpeg("faststart", start)
+	if err != nil {
+		return video, err
+	}
+	defer os.Remove(processedFilePath)
+
+	processedFile, err := os.Open(processedFilePath)
+	if err != nil {
+		return video, err
+	}
+	defer processedFile.Close()
+
+	stat, err := processedFile.Stat()
+	if err != nil {
+		return video, err
+	}
+
+	contentHash, err := hashFile(processedFilePath)
+	if err != nil {
+		return video, err
+	}
+
+	// keep the aspect ratio prefix the video was filed under
+	newKey := path.Dir(videoKey) + "/" + contentHash
+	var uploaded []string
+	saved := false
+	defer func() {
+		if !saved {
+			cfg.deleteUnsavedObjects(context.WithoutCancel(ctx), video, newKey, nil, uploaded)
+		}
+	}()
+	unlockObject := func() {}
+	if newKey != videoKey {
+		// held until the video points at newKey, as in processVideoUpload
+		unlockObject = sync.OnceFunc(cfg.lockVideoObject(store, newKey))
+		defer unlockObject()
+		exists, err := cfg.s3ObjectExists(ctx, store, newKey)
+		if err != nil {
+			return video, err
+		}
+		if !exists {
+			err = cfg.uploadToS3WithChecksum(ctx, store, newKey, processedFile, "video/mp4", cfg.videoStorageClass(video), contentHash)
+			if err != nil {
+				return video, err
+			}
+			uploaded = append(uploaded, newKey)
+		}
+
+		if len(video.Resolutions) > 1 {
+			for _, height := range video.Resolutions[1:] {
+				exists, err := cfg.s3ObjectExists(ctx, store, renditionKey(newKey, height))
+				if err != nil {
+					return video, err
+				}
+				if exists {
+					continue
+				}
+				err = cfg.copyS3Object(ctx, store, renditionKey(videoKey, height), renditionKey(newKey, height), cfg.videoStorageClass(video))
+				if err != nil {
+					return video, err
+				}
+				uploaded = append(uploaded, renditionKey(newKey, height))
+			}
+		}
+	}
+
+	current, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		return video, err
+	}
+	previous := current
+
+	newURL := store.distribution + newKey
+	current.VideoURL = &newURL
+	current.SizeBytes = stat.Size()
+	current.FastStart = true
+	current.ChecksumSHA256 = contentHash
+
+	err = cfg.db.UpdateVideo(current)
+	if err != nil {
+		return video, err
+	}
+	saved = true
+	unlockObject()
+
+	cfg.deleteReplacedObjects(ctx, previous, current)
+	cfg.archiveNewObjects(ctx, current)
+	return current, nil
+}
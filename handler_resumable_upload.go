@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads follow the shape of the tus protocol: POST declares the
+// size, PATCH appends a chunk described by Content-Range, and HEAD reports
+// the Upload-Offset to resume from after a dropped connection.
+
+// resumableUploadPath is where the bytes received so far are kept. Its size
+// is the upload's offset.
+func (cfg *apiConfig) resumableUploadPath(id uuid.UUID) string {
+	return filepath.Join(cfg.tempDir, "tubely-resumable-"+id.String())
+}
+
+// resumableUploadOffset is the number of bytes received so far
+func (cfg *apiConfig) resumableUploadOffset(id uuid.UUID) (int64, error) {
+	info, err := os.Stat(cfg.resumableUploadPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+type resumableUploadResponse struct {
+	database.ResumableUpload
+	Offset int64 `json:"offset"`
+}
+
+func (cfg *apiConfig) handlerResumableUploadCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		SizeBytes int64  `json:"size_bytes"`
+		Filename  string `json:"filename"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	userID := userIDFromContext(r)
+	role := roleFromContext(r)
+
+	if !cfg.requireVerifiedEmail(w, userID) {
+		return
+	}
+
+	if cfg.uploadLimiter != nil {
+		allowed, retryAfter := cfg.uploadLimiter.allow(userID)
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			cfg.metrics.uploadFailed("rate_limited")
+			respondWithError(w, http.StatusTooManyRequests, "Too many uploads, try again later", nil)
+			return
+		}
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if !requireOwnerOrAdmin(video.UserID, userID, role) {
+		respondWithError(w, http.StatusForbidden, "You don't have permission to upload to this video", nil)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.SizeBytes < minUploadBytes {
+		cfg.metrics.uploadFailed("too_small")
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Upload is too small to be a video", nil)
+		return
+	}
+	if params.SizeBytes > cfg.maxUploadBytes {
+		cfg.metrics.uploadFailed("too_large")
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Video exceeds the maximum upload size of %s", formatBytes(cfg.maxUploadBytes)), nil)
+		return
+	}
+
+	if cfg.userQuotaBytes > 0 {
+		usedBytes, err := cfg.db.GetUserStorageBytes(video.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get storage usage", err)
+			return
+		}
+		// the upload replaces this video's current files, so don't count them twice
+		if usedBytes-video.SizeBytes-video.OriginalSizeBytes+params.SizeBytes > cfg.userQuotaBytes {
+			cfg.metrics.uploadFailed("quota")
+			respondWithErrorCode(w, http.StatusForbidden, errCodeQuotaExceeded, "Upload would exceed your storage quota", nil)
+			return
+		}
+	}
+
+	upload, err := cfg.db.CreateResumableUpload(database.CreateResumableUploadParams{
+		VideoID:   video.ID,
+		UserID:    video.UserID,
+		SizeBytes: params.SizeBytes,
+		Filename:  sanitizeFilename(params.Filename),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/uploads/"+upload.ID.String())
+	w.Header().Set("Upload-Offset", "0")
+	respondWithJSON(w, http.StatusCreated, resumableUploadResponse{ResumableUpload: upload})
+}
+
+// getResumableUpload returns the upload named in the path. Uploads that
+// don't belong to the caller are reported as missing.
+func (cfg *apiConfig) getResumableUpload(w http.ResponseWriter, r *http.Request) (database.ResumableUpload, bool) {
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid upload ID", err)
+		return database.ResumableUpload{}, false
+	}
+
+	userID := userIDFromContext(r)
+	role := roleFromContext(r)
+
+	upload, err := cfg.db.GetResumableUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.ResumableUpload{}, false
+	}
+	if upload.ID == uuid.Nil || !requireOwnerOrAdmin(upload.UserID, userID, role) {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return database.ResumableUpload{}, false
+	}
+	return upload, true
+}
+
+// handlerResumableUploadHead reports how much of the upload has arrived, so
+// a client can resume from there
+func (cfg *apiConfig) handlerResumableUploadHead(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getResumableUpload(w, r)
+	if !ok {
+		return
+	}
+
+	offset, err := cfg.resumableUploadOffset(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload offset", err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.SizeBytes, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerResumableUploadPatch appends the chunk in the body, which must start
+// at the current offset. Once the last byte arrives the upload is queued for
+// processing. A PATCH to an upload that's complete but couldn't be queued
+// retries queueing it.
+func (cfg *apiConfig) handlerResumableUploadPatch(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getResumableUpload(w, r)
+	if !ok {
+		return
+	}
+
+	unlock := cfg.uploadLocks.lock(upload.ID.String())
+	defer unlock()
+
+	// a PATCH that held the lock before us may have finished the upload,
+	// which deletes its row and hands the file to the processing worker
+	upload, err := cfg.db.GetResumableUpload(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return
+	}
+	if upload.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+
+	offset, err := cfg.resumableUploadOffset(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload offset", err)
+		return
+	}
+
+	if offset < upload.SizeBytes {
+		start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid Content-Range", err)
+			return
+		}
+		if total != upload.SizeBytes {
+			respondWithError(w, http.StatusBadRequest, "Content-Range total doesn't match the upload size", nil)
+			return
+		}
+		if start != offset {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			respondWithError(w, http.StatusConflict, "Chunk doesn't start at the upload offset", nil)
+			return
+		}
+
+		length := end - start + 1
+		r.Body = http.MaxBytesReader(w, r.Body, length)
+
+		file, err := os.OpenFile(cfg.resumableUploadPath(upload.ID), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't open upload file", err)
+			return
+		}
+		// whatever arrives is kept, so a dropped chunk resumes where it broke off
+		written, copyErr := io.CopyN(file, r.Body, length)
+		err = file.Close()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save chunk", err)
+			return
+		}
+		offset += written
+
+		err = cfg.db.TouchResumableUpload(upload.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update upload", err)
+			return
+		}
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		if copyErr != nil {
+			respondWithError(w, http.StatusBadRequest, "Chunk ended before its Content-Range", copyErr)
+			return
+		}
+		if offset < upload.SizeBytes {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	cfg.finishResumableUpload(w, r, upload)
+}
+
+// finishResumableUpload checks the completed file and hands it to the
+// processing worker
+func (cfg *apiConfig) finishResumableUpload(w http.ResponseWriter, r *http.Request, upload database.ResumableUpload) {
+	rawPath := cfg.resumableUploadPath(upload.ID)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.SizeBytes, 10))
+
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		cfg.discardResumableUpload(upload.ID)
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	file, err := os.Open(rawPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload file", err)
+		return
+	}
+	mediaType, err := detectContentType(file)
+	file.Close()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read video file", err)
+		return
+	}
+	if mediaType != "video/mp4" && mediaType != "video/quicktime" && mediaType != "video/webm" {
+		cfg.discardResumableUpload(upload.ID)
+		cfg.metrics.uploadFailed("invalid_format")
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Invalid video format", nil)
+		return
+	}
+	if !cfg.requireAcceptedVideo(w, r.Context(), rawPath) {
+		cfg.discardResumableUpload(upload.ID)
+		return
+	}
+
+	err = cfg.enqueueProcessing(processingJob{
+		videoID:          video.ID,
+		rawPath:          rawPath,
+		mediaType:        mediaType,
+		originalFilename: upload.Filename,
+	})
+	if errors.Is(err, errProcessingQueueFull) {
+		cfg.metrics.uploadFailed("queue_full")
+		respondWithError(w, http.StatusServiceUnavailable, "Too many videos processing, try again later", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+	cfg.metrics.observeUpload(upload.SizeBytes, upload.CreatedAt)
+
+	// the processing worker owns the file now, so only the row goes
+	err = cfg.db.DeleteResumableUpload(upload.ID)
+	if err != nil {
+		slog.Error("Couldn't delete finished upload", "upload_id", upload.ID, "error", err)
+	}
+
+	video.ProcessingStatus = database.VideoStatusProcessing
+	video.ProcessingError = ""
+	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, signedVideo)
+}
+
+// discardResumableUpload deletes an upload and the bytes received for it
+func (cfg *apiConfig) discardResumableUpload(id uuid.UUID) {
+	err := cfg.db.DeleteResumableUpload(id)
+	if err != nil {
+		slog.Error("Couldn't delete upload", "upload_id", id, "error", err)
+	}
+	os.Remove(cfg.resumableUploadPath(id))
+}
+
+// parseContentRange parses "bytes start-end/total"
+func parseContentRange(header string) (start, end, total int64, err error) {
+	_, err = fmt.Sscanf(header, "bytes %d-%d/%d", &start, &end, &total)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("expected bytes start-end/total, got %q", header)
+	}
+	if start < 0 || end < start || end >= total {
+		return 0, 0, 0, fmt.Errorf("range %d-%d doesn't fit in %d bytes", start, end, total)
+	}
+	return start, end, total, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerShareLinkCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		// ExpiresInSeconds shortens the link's lifetime below the default
+		ExpiresInSeconds int `json:"expires_in_seconds"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	expiresIn := cfg.shareLinkExpiry
+	if params.ExpiresInSeconds != 0 {
+		requested := time.Duration(params.ExpiresInSeconds) * time.Second
+		if requested < 0 || requested > cfg.shareLinkExpiry {
+			respondWithError(w, http.StatusBadRequest, "Expiry must be between 1 second and "+cfg.shareLinkExpiry.String(), nil)
+			return
+		}
+		expiresIn = requested
+	}
+
+	tokenBytes := make([]byte, 32)
+	_, err = rand.Read(tokenBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate share token", err)
+		return
+	}
+
+	link, err := cfg.db.CreateShareLink(database.CreateShareLinkParams{
+		Token:     base64.RawURLEncoding.EncodeToString(tokenBytes),
+		VideoID:   video.ID,
+		ExpiresAt: time.Now().UTC().Add(expiresIn),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share link", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, link)
+}
+
+func (cfg *apiConfig) handlerShareLinksList(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := cfg.db.GetActiveShareLinks(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get share links", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, links)
+}
+
+func (cfg *apiConfig) handlerShareLinkRevoke(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	revoked, err := cfg.db.RevokeShareLink(video.ID, r.PathValue("token"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke share link", err)
+		return
+	}
+	if !revoked {
+		respondWithError(w, http.StatusNotFound, "Couldn't get share link", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerShareLinkResolve lets anyone holding an active share token watch the
+// video, whatever its visibility
+func (cfg *apiConfig) handlerShareLinkResolve(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Title        string             `json:"title"`
+		Description  string             `json:"description"`
+		VideoURL     *string            `json:"video_url"`
+		ThumbnailURL *string            `json:"thumbnail_url"`
+		HLSURL       *string            `json:"hls_url"`
+		Captions     database.StringMap `json:"captions"`
+		ExpiresAt    time.Time          `json:"expires_at"`
+	}
+
+	link, err := cfg.db.GetShareLink(r.PathValue("token"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get share link", err)
+		return
+	}
+	if link.Token == "" || link.RevokedAt != nil || link.ExpiresAt.Before(time.Now()) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get share link", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(link.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// share links get around private visibility but not moderation
+	if video.ID == uuid.Nil || video.DeletedAt != nil || video.VideoURL == nil ||
+		video.ProcessingStatus == database.VideoStatusUnderReview || video.ProcessingStatus == database.VideoStatusRejected {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	video, err = cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Title:        video.Title,
+		Description:  video.Description,
+		VideoURL:     video.VideoURL,
+		ThumbnailURL: video.ThumbnailURL,
+		HLSURL:       video.HLSURL,
+		Captions:     video.Captions,
+		ExpiresAt:    link.ExpiresAt,
+	})
+}
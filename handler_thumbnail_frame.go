@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerVideoThumbnailFrame replaces a video's thumbnail with the frame at
+// ?atSeconds=, for when the automatic pick is a poor poster frame
+func (cfg *apiConfig) handlerVideoThumbnailFrame(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	atSeconds, err := strconv.ParseFloat(r.URL.Query().Get("atSeconds"), 64)
+	if err != nil || math.IsNaN(atSeconds) || math.IsInf(atSeconds, 0) {
+		respondWithError(w, http.StatusBadRequest, "atSeconds must be a number", err)
+		return
+	}
+
+	// reprocessing replaces the stored file, so take turns with it
+	unlock := cfg.reprocessLocks.lock(video.ID.String())
+	defer unlock()
+
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	if video.ProcessingStatus == database.VideoStatusPending || video.ProcessingStatus == database.VideoStatusProcessing {
+		respondWithErrorCode(w, http.StatusConflict, errCodeStillProcessing, "Video is still processing", nil)
+		return
+	}
+	if video.DurationSeconds <= 0 {
+		respondWithError(w, http.StatusConflict, "Video duration is unknown", nil)
+		return
+	}
+	if atSeconds < 0 || atSeconds >= video.DurationSeconds {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("atSeconds must be at least 0 and less than the video's duration of %.3f seconds", video.DurationSeconds), nil)
+		return
+	}
+
+	video, err = cfg.replaceThumbnailFromFrame(r.Context(), video, atSeconds)
+	if errors.Is(err, context.DeadlineExceeded) {
+		respondWithError(w, http.StatusGatewayTimeout, "Thumbnail generation timed out", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't replace thumbnail", err)
+		return
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// replaceThumbnailFromFrame downloads the stored video, extracts the frame at
+// atSeconds and stores it as the video's thumbnail, deleting the old one
+func (cfg *apiConfig) replaceThumbnailFromFrame(ctx context.Context, video database.Video, atSeconds float64) (database.Video, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.processTimeout)
+	defer cancel()
+
+	videoKey, ok := cfg.objectKeyFromURL(video.VideoURL)
+	if !ok {
+		return video, errors.New("video isn't stored in the bucket")
+	}
+
+	tempFile, err := os.CreateTemp(cfg.tempDir, "tubely-frame-*.mp4")
+	if err != nil {
+		return video, err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	err = cfg.downloadS3Object(ctx, cfg.videoStore(video), videoKey, tempFile)
+	if err != nil {
+		return video, err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return video, err
+	}
+
+	release, err := cfg.acquireFFmpeg(ctx)
+	if err != nil {
+		return video, err
+	}
+	start := time.Now()
+	thumbnailPath, err := generateThumbnail(ctx, tempFile.Name(), atSeconds, cfg.thumbnailOptions)
+	release()
+	cfg.metrics.observeFFmpeg("thumbnail", start)
+	if err != nil {
+		return video, err
+	}
+	defer os.Remove(thumbnailPath)
+
+	thumbnailFile, err := os.Open(thumbnailPath)
+	if err != nil {
+		return video, err
+	}
+	defer thumbnailFile.Close()
+
+	return cfg.storeThumbnail(ctx, video, thumbnailFile, cfg.thumbnailOptions.extension(), cfg.thumbnailOptions.contentType())
+}
@@ -1,104 +1,75 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
-
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
-	"github.com/google/uuid"
 )
 
+// thumbnailImageTypes maps the image types accepted as custom thumbnails to
+// the extension they're stored with
+var thumbnailImageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// handlerUploadThumbnail replaces a video's thumbnail with an uploaded image.
+// The type is sniffed from the file itself rather than trusted from the form.
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
-		return
-	}
+	// leave room for the multipart framing around the image
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxThumbnailSize+1<<10)
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	file, _, err := r.FormFile("thumbnail")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Thumbnail exceeds the maximum size of %s", formatBytes(cfg.maxThumbnailSize)), err)
 		return
 	}
-
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
-
-	const maxMemory = 10 << 20
-	r.ParseMultipartForm(maxMemory)
-
-	file, fileHeader, err := r.FormFile("thumbnail")
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Bad Request", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't get thumbnail file", err)
 		return
 	}
-
-	mediaType, _, err := mime.ParseMediaType(fileHeader.Header.Get("Content-Type"))
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid media type", err)
-		return
-	}
-	if mediaType != "image/jpeg" && mediaType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Invalid media type", nil)
-		return
-	}
-
 	defer file.Close()
 
-	metadata, err := cfg.db.GetVideo(videoID)
+	image, err := io.ReadAll(io.LimitReader(file, cfg.maxThumbnailSize+1))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't read thumbnail file", err)
 		return
 	}
-
-	if metadata.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "User does not have permission to upload thumbnail", nil)
+	if int64(len(image)) > cfg.maxThumbnailSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Thumbnail exceeds the maximum size of %s", formatBytes(cfg.maxThumbnailSize)), nil)
 		return
 	}
 
-	fileExtenstion, ok := strings.CutPrefix(mediaType, "image/")
+	mediaType := http.DetectContentType(image)
+	extension, ok := thumbnailImageTypes[mediaType]
 	if !ok {
-		respondWithError(w, http.StatusBadRequest, "Invalid media type", nil)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Thumbnail must be a JPEG, PNG or WebP image", nil)
 		return
 	}
 
-	randomBytes := make([]byte, 32)
-	rand.Read(randomBytes)
-	randomString := base64.RawURLEncoding.EncodeToString(randomBytes)
-
-	thumbnailPath := filepath.Join(cfg.assetsRoot, randomString+"."+fileExtenstion)
-	thumbnailFile, err := os.Create(thumbnailPath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create thumbnail file", err)
-		return
-	}
+	// the frame endpoint replaces thumbnails too, so take turns with it
+	unlock := cfg.reprocessLocks.lock(video.ID.String())
+	defer unlock()
 
-	_, err = io.Copy(thumbnailFile, file)
+	video, err = cfg.storeThumbnail(r.Context(), video, bytes.NewReader(image), extension, mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't copy thumbnail file", err)
+		respondWithError(w, s3ErrorStatus(err), "Couldn't save thumbnail", err)
 		return
 	}
 
-	thumbnailURL := "http://localhost:8091/assets/" + randomString + "." + fileExtenstion
-	metadata.ThumbnailURL = &thumbnailURL
-	err = cfg.db.UpdateVideo(metadata)
+	signedVideo, err := cfg.dbVideoToSignedVideo(video)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video metadata", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
 		return
 	}
-
-	respondWithJSON(w, http.StatusOK, metadata)
+	respondWithJSON(w, http.StatusOK, signedVideo)
 }
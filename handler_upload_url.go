@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const directUploadExpiry = 15 * time.Minute
+
+// handlerVideoUploadURL hands the browser a presigned POST policy so it can
+// upload the raw video straight to S3 instead of through this server.
+// handlerVideoUploadComplete picks the upload up from there.
+func (cfg *apiConfig) handlerVideoUploadURL(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		URL       string            `json:"url"`
+		Fields    map[string]string `json:"fields"`
+		Key       string            `json:"key"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	userID := userIDFromContext(r)
+	role := roleFromContext(r)
+
+	if !cfg.requireVerifiedEmail(w, userID) {
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if !requireOwnerOrAdmin(video.UserID, userID, role) || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	randomBytes := make([]byte, 32)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate upload key", err)
+		return
+	}
+	uploadKey := cfg.keyPrefix + "uploads/" + videoID.String() + "/" + base64.RawURLEncoding.EncodeToString(randomBytes)
+
+	maxUploadBytes := cfg.maxUploadBytes
+	if cfg.userQuotaBytes > 0 {
+		usedBytes, err := cfg.db.GetUserStorageBytes(video.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get storage usage", err)
+			return
+		}
+		remaining := cfg.userQuotaBytes - usedBytes + video.SizeBytes + video.OriginalSizeBytes
+		if remaining < minUploadBytes {
+			respondWithErrorCode(w, http.StatusForbidden, errCodeQuotaExceeded, "Upload would exceed your storage quota", nil)
+			return
+		}
+		maxUploadBytes = min(maxUploadBytes, remaining)
+	}
+
+	// presigned POSTs don't pick encryption up from the input, so it has to
+	// be part of the policy
+	sseFields := map[string]string{}
+	if cfg.s3SSE != "" {
+		sseFields["x-amz-server-side-encryption"] = string(cfg.s3SSE)
+	}
+	if cfg.kmsKeyID != nil {
+		sseFields["x-amz-server-side-encryption-aws-kms-key-id"] = *cfg.kmsKeyID
+	}
+
+	// the browser uploads straight to the bucket of the video's region
+	store := cfg.videoStore(video)
+	presigned, err := store.presignClient.PresignPostObject(r.Context(), &s3.PutObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(uploadKey),
+	}, func(opts *s3.PresignPostOptions) {
+		opts.Expires = directUploadExpiry
+		opts.Conditions = []interface{}{
+			[]interface{}{"content-length-range", minUploadBytes, maxUploadBytes},
+			[]interface{}{"starts-with", "$Content-Type", "video/"},
+		}
+		for field, value := range sseFields {
+			opts.Conditions = append(opts.Conditions, map[string]string{field: value})
+		}
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+	// the policy requires these, so the browser has to send them back
+	for field, value := range sseFields {
+		presigned.Values[field] = value
+	}
+
+	// a replaced upload that was never finalized is left to expire with the policy
+	video.UploadKey = &uploadKey
+	err = cfg.db.WithTx(func(tx database.Tx) error {
+		err := tx.UpdateVideo(video)
+		if err != nil {
+			return err
+		}
+		return tx.SetVideoProcessingStatus(video.ID, database.VideoStatusPending, "")
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		URL:       presigned.URL,
+		Fields:    presigned.Values,
+		Key:       uploadKey,
+		ExpiresAt: time.Now().Add(directUploadExpiry),
+	})
+}
+
+// handlerVideoUploadComplete is called by the browser once its direct upload
+// has finished. It pulls the raw object back down and queues it for the same
+// processing as handlerUploadVideo, which removes the raw object when done.
+func (cfg *apiConfig) handlerVideoUploadComplete(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	userID := userIDFromContext(r)
+	role := roleFromContext(r)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if !requireOwnerOrAdmin(video.UserID, userID, role) || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	// a failed upload keeps its key, so it can be finalized again
+	if video.UploadKey == nil || (video.ProcessingStatus != database.VideoStatusPending && video.ProcessingStatus != database.VideoStatusFailed) {
+		respondWithError(w, http.StatusConflict, "Video has no pending upload", nil)
+		return
+	}
+	uploadKey := *video.UploadKey
+	store := cfg.videoStore(video)
+
+	headCtx, cancel := cfg.s3Context(r.Context())
+	head, err := store.client.HeadObject(headCtx, &s3.HeadObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(uploadKey),
+	})
+	cancel()
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		respondWithError(w, http.StatusConflict, "Upload hasn't reached S3 yet", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, s3ErrorStatus(err), "Couldn't check the upload", err)
+		return
+	}
+	if aws.ToInt64(head.ContentLength) < minUploadBytes {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Upload is too small to be a video", nil)
+		return
+	}
+
+	tempFile, err := os.CreateTemp(cfg.tempDir, uploadTempPattern)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
+		return
+	}
+
+	// once queued, the processing worker owns the file
+	queued := false
+	defer func() {
+		if !queued {
+			os.Remove(tempFile.Name())
+		}
+	}()
+	defer tempFile.Close()
+
+	err = cfg.downloadS3Object(r.Context(), store, uploadKey, tempFile)
+	if err != nil {
+		respondWithError(w, s3ErrorStatus(err), "Couldn't download upload from S3", err)
+		return
+	}
+
+	mediaType, err := detectContentType(tempFile)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read video file", err)
+		return
+	}
+	if mediaType != "video/mp4" && mediaType != "video/quicktime" && mediaType != "video/webm" {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Invalid video format", nil)
+		return
+	}
+
+	err = tempFile.Close()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save video file", err)
+		return
+	}
+
+	if !cfg.requireAcceptedVideo(w, r.Context(), tempFile.Name()) {
+		return
+	}
+
+	err = cfg.enqueueProcessing(processingJob{
+		videoID:   video.ID,
+		rawPath:   tempFile.Name(),
+		mediaType: mediaType,
+		uploadKey: uploadKey,
+	})
+	if errors.Is(err, errProcessingQueueFull) {
+		respondWithError(w, http.StatusServiceUnavailable, "Too many videos processing, try again later", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+	queued = true
+
+	video.ProcessingStatus = database.VideoStatusProcessing
+	video.ProcessingError = ""
+	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, signedVideo)
+}
@@ -1,41 +1,61 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"mime"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+const minUploadBytes = 1 << 10
+
+// uploadTempPattern names the temp file an upload is copied to. The random
+// part replaces the *, so the name still ends in .mp4 and the files
+// processing writes next to it, named after it, are as unique as it is.
+const uploadTempPattern = "tubely-upload-*.mp4"
+
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	sizeLimit := 1 << 30
-	r.Body = http.MaxBytesReader(w, r.Body, int64(sizeLimit))
+	start := time.Now()
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxUploadBytes)
 
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+	userID := userIDFromContext(r)
+	role := roleFromContext(r)
+
+	if !cfg.requireVerifiedEmail(w, userID) {
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
-		return
+	if cfg.uploadLimiter != nil {
+		allowed, retryAfter := cfg.uploadLimiter.allow(userID)
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			cfg.metrics.uploadFailed("rate_limited")
+			respondWithError(w, http.StatusTooManyRequests, "Too many uploads, try again later", nil)
+			return
+		}
 	}
 
 	metadata, err := cfg.db.GetVideo(videoID)
@@ -43,13 +63,24 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusNotFound, "Video not found", err)
 		return
 	}
+	// a trashed video can't be given a new file until it's restored
+	if metadata.ID == uuid.Nil || metadata.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
 
-	if metadata.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "User does not have access to this video", err)
+	if !requireOwnerOrAdmin(metadata.UserID, userID, role) {
+		respondWithError(w, http.StatusForbidden, "You don't have permission to upload to this video", nil)
 		return
 	}
 
 	videoFile, videoHeader, err := r.FormFile("video")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		cfg.metrics.uploadFailed("too_large")
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Video exceeds the maximum upload size of %s", formatBytes(cfg.maxUploadBytes)), err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Couldn't get video file", err)
 		return
@@ -57,81 +88,288 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 
 	defer videoFile.Close()
 
+	if cfg.userQuotaBytes > 0 {
+		usedBytes, err := cfg.db.GetUserStorageBytes(metadata.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get storage usage", err)
+			return
+		}
+
+		// the upload replaces this video's current files, so don't count them twice
+		if usedBytes-metadata.SizeBytes-metadata.OriginalSizeBytes+videoHeader.Size > cfg.userQuotaBytes {
+			cfg.metrics.uploadFailed("quota")
+			respondWithErrorCode(w, http.StatusForbidden, errCodeQuotaExceeded, "Upload would exceed your storage quota", nil)
+			return
+		}
+	}
+
 	mediaType, _, err := mime.ParseMediaType(videoHeader.Header.Get("Content-Type"))
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse media type", err)
+		cfg.metrics.uploadFailed("invalid_format")
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Couldn't parse media type", err)
 		return
 	}
 
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Invalid video format", err)
+	if mediaType != "video/mp4" && mediaType != "video/quicktime" && mediaType != "video/webm" {
+		cfg.metrics.uploadFailed("invalid_format")
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Invalid video format", err)
+		return
+	}
+
+	// an empty file would otherwise fail sniffing with a confusing message
+	if videoHeader.Size == 0 {
+		cfg.metrics.uploadFailed("too_small")
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Empty upload", nil)
 		return
 	}
 
-	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	sniffedType, err := detectContentType(videoFile)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read video file", err)
+		return
+	}
+
+	if sniffedType != mediaType && !(mediaType == "video/quicktime" && sniffedType == "video/mp4") {
+		cfg.metrics.uploadFailed("invalid_format")
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "File contents don't match declared type "+mediaType+" (detected "+sniffedType+")", nil)
+		return
+	}
+
+	tempFile, err := os.CreateTemp(cfg.tempDir, uploadTempPattern)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
 		return
 	}
 
-	defer os.Remove(tempFile.Name())
+	// once queued, the processing worker owns the file
+	queued := false
+	defer func() {
+		if !queued {
+			os.Remove(tempFile.Name())
+		}
+	}()
 	defer tempFile.Close()
 
-	io.Copy(tempFile, videoFile)
-	tempFile.Seek(0, io.SeekStart)
-
-	processedFilePath, err := processVideoForFastStart(tempFile.Name())
+	written, readErr, err := copyUpload(tempFile, videoFile)
+	if readErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read video file", readErr)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video: "+err.Error(), err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save video file", err)
+		return
+	}
+	if written < minUploadBytes {
+		cfg.metrics.uploadFailed("too_small")
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidFormat, "Upload is too small to be a video", nil)
 		return
 	}
 
-	processedFile, err := os.Open(processedFilePath)
+	err = tempFile.Close()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed file", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save video file", err)
 		return
 	}
 
-	defer os.Remove(processedFile.Name())
-	defer processedFile.Close()
+	// the deferred cleanup removes the temp file, since nothing gets queued
+	if r.URL.Query().Get("validate") == "true" {
+		respondWithJSON(w, http.StatusOK, cfg.validateUpload(r.Context(), tempFile.Name(), mediaType))
+		return
+	}
 
-	randomBytes := make([]byte, 32)
-	rand.Read(randomBytes)
+	if !cfg.requireAcceptedVideo(w, r.Context(), tempFile.Name()) {
+		return
+	}
 
-	videoKey := base64.RawURLEncoding.EncodeToString(randomBytes)
+	err = cfg.enqueueProcessing(processingJob{
+		videoID:          metadata.ID,
+		rawPath:          tempFile.Name(),
+		mediaType:        mediaType,
+		originalFilename: sanitizeFilename(videoHeader.Filename),
+	})
+	if errors.Is(err, errProcessingQueueFull) {
+		cfg.metrics.uploadFailed("queue_full")
+		respondWithError(w, http.StatusServiceUnavailable, "Too many videos processing, try again later", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+	queued = true
+	cfg.metrics.observeUpload(written, start)
 
-	videoRatio, err := getVideoAspectRatio(tempFile.Name())
+	metadata.ProcessingStatus = database.VideoStatusProcessing
+	metadata.ProcessingError = ""
+	signedVideo, err := cfg.dbVideoToSignedVideo(metadata)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get video ratio", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video", err)
 		return
 	}
+	respondWithJSON(w, http.StatusAccepted, signedVideo)
+}
 
-	aspectRatio := "other"
-	if videoRatio == "16:9" {
-		aspectRatio = "landscape"
-	} else if videoRatio == "9:16" {
-		aspectRatio = "portrait"
+// uploadValidation is the verdict for an upload sent with ?validate=true,
+// which runs the checks a real upload would without storing anything
+type uploadValidation struct {
+	Valid           bool    `json:"valid"`
+	Error           string  `json:"error,omitempty"`
+	MediaType       string  `json:"media_type"`
+	SizeBytes       int64   `json:"size_bytes"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	VideoCodec      string  `json:"video_codec"`
+	AudioCodec      string  `json:"audio_codec,omitempty"`
+	// Reencode is set when processing will have to re-encode the video
+	// because it isn't in an allowed codec
+	Reencode bool `json:"reencode"`
+}
+
+// validateUpload probes the file at path for the checks that need ffprobe.
+// Checks on the request itself, like size and format, have already failed
+// with an error response by the time this runs.
+func (cfg *apiConfig) validateUpload(ctx context.Context, path, mediaType string) uploadValidation {
+	validation := uploadValidation{MediaType: mediaType}
+
+	metadata, err := getVideoMetadata(ctx, path)
+	if err != nil {
+		validation.Error = "Couldn't probe video metadata"
+		return validation
 	}
+	validation.SizeBytes = metadata.SizeBytes
+	validation.DurationSeconds = metadata.DurationSeconds
+	validation.Width = metadata.Width
+	validation.Height = metadata.Height
+	validation.VideoCodec = metadata.Codec
+	validation.AudioCodec = metadata.AudioCodec
 
-	videoKey = aspectRatio + "/" + videoKey
+	if metadata.DurationSeconds <= 0 {
+		validation.Error = "Video has no duration"
+		return validation
+	}
+	if message := cfg.durationError(metadata); message != "" {
+		validation.Error = message
+		return validation
+	}
+	if codec := cfg.codecs.disallowedCodec(metadata); codec != "" {
+		if cfg.strictCodecs {
+			validation.Error = cfg.codecs.codecError(codec)
+			return validation
+		}
+		validation.Reencode = true
+	}
+	// anything but mp4 is converted before processing
+	if mediaType != "video/mp4" {
+		validation.Reencode = true
+	}
 
-	_, err = cfg.s3Client.PutObject(context.Background(), &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(videoKey),
-		Body:        processedFile,
-		ContentType: aws.String(mediaType),
-	})
+	validation.Valid = true
+	return validation
+}
+
+// copyUpload copies an upload into file. Failing to read the upload, say
+// because the client went away or the request was cancelled, is returned as
+// readErr and is the client's problem; only writeErr is ours.
+func copyUpload(file io.Writer, upload io.Reader) (written int64, readErr, writeErr error) {
+	reader := &uploadReader{reader: upload}
+	written, err := io.Copy(file, reader)
+	if reader.err != nil {
+		return written, reader.err, nil
+	}
+	return written, nil, err
+}
+
+// uploadReader keeps the first error reading from reader other than io.EOF
+type uploadReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.reader.Read(p)
+	if err != nil && err != io.EOF && u.err == nil {
+		u.err = err
+	}
+	return n, err
+}
+
+func detectContentType(file io.ReadSeeker) (string, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	_, err = file.Seek(0, io.SeekStart)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't upload video to S3", err)
-		return
+		return "", err
+	}
+
+	// http.DetectContentType only recognizes mp4 brands, so check for the
+	// QuickTime brand in the ftyp box ourselves
+	if len(header) >= 12 && bytes.Equal(header[4:8], []byte("ftyp")) && bytes.Equal(header[8:12], []byte("qt  ")) {
+		return "video/quicktime", nil
+	}
+
+	return http.DetectContentType(header), nil
+}
+
+const maxFilenameBytes = 255
+
+// sanitizeFilename keeps only the base name of a client supplied filename,
+// drops control characters and truncates it to maxFilenameBytes
+func sanitizeFilename(name string) string {
+	// browsers on Windows have been known to send the full path
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(name)
+	if name == "." || name == "/" {
+		return ""
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(name, ""))
+
+	if len(name) > maxFilenameBytes {
+		cut := maxFilenameBytes
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = name[:cut]
+	}
+	return strings.TrimSpace(name)
+}
+
+// formatBytes renders a size like 1.5 GiB for error messages
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
 	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
 
-	newURL := cfg.s3CfDistribution + videoKey
-	metadata.VideoURL = &newURL
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
 
-	err = cfg.db.UpdateVideo(metadata)
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-		return
+		return "", err
 	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
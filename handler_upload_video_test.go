@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// testMP4 is size bytes that sniff as an MP4, an ftyp atom padded out with
+// mdat
+func testMP4(size int) []byte {
+	data := atom("ftyp", []byte("isom\x00\x00\x02\x00isomiso2avc1mp41"))
+	return append(data, atom("mdat", make([]byte, size-len(data)-8))...)
+}
+
+// videoForm is a multipart body carrying data as the video field
+func videoForm(t *testing.T, data io.Reader) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	// a fixed boundary keeps the form's overhead the same between calls
+	form.SetBoundary("tubely-test-boundary")
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="video.mp4"`)
+	header.Set("Content-Type", "video/mp4")
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(part, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Close()
+	return body, form.FormDataContentType()
+}
+
+// uploadVideo sends body to handlerUploadVideo as the video's owner
+func uploadVideo(cfg *apiConfig, video database.Video, token string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, "/api/videos/"+video.ID.String()+"/video", body)
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	cfg.requireAuth(cfg.handlerUploadVideo)(w, r)
+	return w
+}
+
+func TestUploadVideoOverLimit(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	video, token := createTestVideo(t, cfg)
+
+	// size the file so the whole request body lands either side of the limit
+	empty, _ := videoForm(t, bytes.NewReader(nil))
+	fileSize := int(cfg.maxUploadBytes) - empty.Len()
+
+	tests := []struct {
+		name     string
+		fileSize int
+		want413  bool
+	}{
+		{"at the limit", fileSize, false},
+		{"one byte over", fileSize + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := videoForm(t, bytes.NewReader(testMP4(tt.fileSize)))
+			w := uploadVideo(cfg, video, token, body, contentType)
+			if got413 := w.Code == http.StatusRequestEntityTooLarge; got413 != tt.want413 {
+				t.Fatalf("status = %d %s, want 413 %v", w.Code, w.Body, tt.want413)
+			}
+			if tt.want413 && !strings.Contains(w.Body.String(), formatBytes(cfg.maxUploadBytes)) {
+				t.Errorf("body = %s, want it to name the maximum size", w.Body)
+			}
+			// the queue holds one job, so empty it for the next upload
+			select {
+			case job := <-cfg.processingQueue:
+				os.Remove(job.rawPath)
+			default:
+			}
+		})
+	}
+}
+
+func TestUploadVideoRejectsEmptyAndTruncatedFiles(t *testing.T) {
+	cfg, bucket := newTestConfig(t)
+	video, token := createTestVideo(t, cfg)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantMessage string
+	}{
+		{"empty", nil, "Empty upload"},
+		{"truncated", testMP4(minUploadBytes - 1), "Upload is too small to be a video"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := videoForm(t, bytes.NewReader(tt.data))
+			w := uploadVideo(cfg, video, token, body, contentType)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.wantMessage) {
+				t.Errorf("response = %d %s, want 400 %q", w.Code, w.Body, tt.wantMessage)
+			}
+		})
+	}
+	if len(cfg.processingQueue) != 0 || len(bucket.keys("")) != 0 {
+		t.Error("a rejected upload was queued or stored")
+	}
+}
+
+// failingReader returns err once the data before it has been read, like a
+// client disconnecting mid upload
+type failingReader struct {
+	data io.Reader
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.data.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+func TestUploadVideoAbortsOnBrokenBody(t *testing.T) {
+	cfg, bucket := newTestConfig(t)
+	video, token := createTestVideo(t, cfg)
+
+	body, contentType := videoForm(t, bytes.NewReader(testMP4(64*1024)))
+	broken := &failingReader{
+		data: bytes.NewReader(body.Bytes()[:body.Len()/2]),
+		err:  io.ErrUnexpectedEOF,
+	}
+	w := uploadVideo(cfg, video, token, broken, contentType)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d %s, want 400", w.Code, w.Body)
+	}
+	if len(cfg.processingQueue) != 0 {
+		t.Error("the partial upload was queued for processing")
+	}
+	if keys := bucket.keys(""); len(keys) != 0 {
+		t.Errorf("bucket holds %v, want nothing stored", keys)
+	}
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ProcessingStatus != video.ProcessingStatus {
+		t.Errorf("status = %q, want it left at %q", stored.ProcessingStatus, video.ProcessingStatus)
+	}
+}
+
+func TestUploadTempFilesAreUnique(t *testing.T) {
+	dir := t.TempDir()
+	const uploads = 50
+
+	paths := make(chan string, uploads)
+	var wg sync.WaitGroup
+	for range uploads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			file, err := os.CreateTemp(dir, uploadTempPattern)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			file.Close()
+			paths <- file.Name()
+		}()
+	}
+	wg.Wait()
+	close(paths)
+
+	seen := map[string]bool{}
+	for path := range paths {
+		if seen[path] {
+			t.Errorf("%s was created twice", path)
+		}
+		seen[path] = true
+		if !strings.HasSuffix(path, ".mp4") {
+			t.Errorf("%s doesn't end in .mp4", path)
+		}
+	}
+	if len(seen) != uploads {
+		t.Errorf("got %d temp files, want %d", len(seen), uploads)
+	}
+}
+
+func TestUploadVideoQuotaCountsOriginals(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.userQuotaBytes = 100 * 1024
+	video, token := createTestVideo(t, cfg)
+
+	// a processed file and its original that together fill most of the quota
+	other, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Other video", UserID: video.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.SizeBytes = 40 * 1024
+	other.OriginalSizeBytes = 40 * 1024
+	err = cfg.db.UpdateVideo(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, contentType := videoForm(t, bytes.NewReader(testMP4(30*1024)))
+	w := uploadVideo(cfg, video, token, body, contentType)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), errCodeQuotaExceeded) {
+		t.Errorf("response = %d %s, want 403 %s", w.Code, w.Body, errCodeQuotaExceeded)
+	}
+}
+
+func TestUploadVideoToDeletedVideo(t *testing.T) {
+	cfg, bucket := newTestConfig(t)
+	video, token := createTestVideo(t, cfg)
+	err := cfg.db.SoftDeleteVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, contentType := videoForm(t, bytes.NewReader(testMP4(64*1024)))
+	w := uploadVideo(cfg, video, token, body, contentType)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d %s, want 404", w.Code, w.Body)
+	}
+	if len(cfg.processingQueue) != 0 || len(bucket.keys("")) != 0 {
+		t.Error("the upload was queued or stored")
+	}
+}
+
+func TestCopyUploadBlamesTheFailingSide(t *testing.T) {
+	t.Run("read", func(t *testing.T) {
+		for _, readErr := range []error{io.ErrUnexpectedEOF, context.Canceled} {
+			upload := &failingReader{data: bytes.NewReader(testMP4(4096)), err: readErr}
+			written, gotRead, gotWrite := copyUpload(io.Discard, upload)
+			if !errors.Is(gotRead, readErr) || gotWrite != nil {
+				t.Errorf("copyUpload = (%v, %v), want read error %v", gotRead, gotWrite, readErr)
+			}
+			if written != 4096 {
+				t.Errorf("written = %d, want 4096", written)
+			}
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		file, err := os.CreateTemp(t.TempDir(), uploadTempPattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		_, gotRead, gotWrite := copyUpload(file, bytes.NewReader(testMP4(4096)))
+		if gotRead != nil || gotWrite == nil {
+			t.Errorf("copyUpload = (%v, %v), want a write error", gotRead, gotWrite)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerUserThumbnails lists a user's public videos with only their title
+// and a signed thumbnail URL, for embedding a gallery on another site. It
+// needs no token, so it's limited per client IP, and never lists private or
+// unlisted videos or hands out video URLs.
+func (cfg *apiConfig) handlerUserThumbnails(w http.ResponseWriter, r *http.Request) {
+	type thumbnail struct {
+		ID           uuid.UUID `json:"id"`
+		Title        string    `json:"title"`
+		ThumbnailURL *string   `json:"thumbnail_url"`
+	}
+
+	if cfg.thumbsLimiter != nil {
+		allowed, retryAfter := cfg.thumbsLimiter.allow(clientIP(r))
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			respondWithError(w, http.StatusTooManyRequests, "Too many requests, try again later", nil)
+			return
+		}
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid user ID", err)
+		return
+	}
+
+	limit, offset, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	videos, total, err := cfg.db.GetAllVideos(database.GetAllVideosParams{
+		UserID:           userID,
+		ProcessingStatus: database.VideoStatusReady,
+		Visibility:       database.VisibilityPublic,
+		Limit:            limit,
+		Offset:           offset,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	response := make([]thumbnail, len(videos))
+	for i, video := range videos {
+		response[i] = thumbnail{ID: video.ID, Title: video.Title}
+		if video.ThumbnailURL == nil {
+			continue
+		}
+		signedURL, _, err := cfg.signURL(*video.ThumbnailURL)
+		if err != nil {
+			// leave this one without a thumbnail rather than failing the page
+			slog.ErrorContext(r.Context(), "Couldn't sign thumbnail URL", "video_id", video.ID, "error", err)
+			continue
+		}
+		response[i].ThumbnailURL = &signedURL
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	respondWithJSON(w, http.StatusOK, response)
+}
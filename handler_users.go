@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"maps"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -12,6 +15,9 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 	type parameters struct {
 		Password string `json:"password"`
 		Email    string `json:"email"`
+		// Region picks where the user's videos are stored, the default
+		// bucket when empty
+		Region string `json:"region"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -26,6 +32,11 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, "Email and password are required", nil)
 		return
 	}
+	if _, ok := cfg.s3Stores[params.Region]; params.Region != "" && !ok {
+		regions := slices.Sorted(maps.Keys(cfg.s3Stores))
+		respondWithError(w, http.StatusBadRequest, "Region must be one of "+strings.Join(regions, ", "), nil)
+		return
+	}
 
 	hashedPassword, err := auth.HashPassword(params.Password)
 	if err != nil {
@@ -36,6 +47,7 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 	user, err := cfg.db.CreateUser(database.CreateUserParams{
 		Email:    params.Email,
 		Password: hashedPassword,
+		Region:   params.Region,
 	})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create user", err)
@@ -44,3 +56,15 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 
 	respondWithJSON(w, http.StatusCreated, user)
 }
+
+func (cfg *apiConfig) handlerUserStats(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r)
+
+	stats, err := cfg.db.GetUserVideoStats(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get stats", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, stats)
+}
@@ -1,38 +1,81 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+// maxTitleLength is the longest title, in characters, a video can have
+const maxTitleLength = 200
+
+// normalizeTitle trims whitespace from a title, collapsing runs of it inside
+// to a single space, and checks what's left, returning why it was rejected
+func normalizeTitle(title string) (string, error) {
+	if !utf8.ValidString(title) {
+		return "", errors.New("must be valid UTF-8")
+	}
+	title = strings.Join(strings.Fields(title), " ")
+	if title == "" {
+		return "", errors.New("can't be empty")
+	}
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		return "", fmt.Errorf("can't be longer than %d characters", maxTitleLength)
+	}
+	if strings.IndexFunc(title, unicode.IsControl) != -1 {
+		return "", errors.New("can't contain control characters")
+	}
+	return title, nil
+}
+
 func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		database.CreateVideoParams
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	userID := userIDFromContext(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	params.UserID = userID
+
+	params.Title, err = normalizeTitle(params.Title)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusBadRequest, "Title "+err.Error(), nil)
+		return
+	}
+	if params.Visibility != "" && !database.ValidVisibility(params.Visibility) {
+		respondWithError(w, http.StatusBadRequest, "Visibility must be public, unlisted or private", nil)
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err = decoder.Decode(&params)
+	// the video's files go to its owner's regional bucket for good, so a
+	// later change of region doesn't strand them
+	user, err := cfg.db.GetUser(userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
 		return
 	}
-	params.UserID = userID
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, "User no longer exists", nil)
+		return
+	}
+	params.Region = user.Region
 
 	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
 	if err != nil {
@@ -43,36 +86,130 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 	respondWithJSON(w, http.StatusCreated, video)
 }
 
-func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handlerVideoMetaUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       *string   `json:"title"`
+		Description *string   `json:"description"`
+		Tags        *[]string `json:"tags"`
+		Visibility  *string   `json:"visibility"`
+		Archived    *bool     `json:"archived"`
+	}
+
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	userID := userIDFromContext(r)
+	role := roleFromContext(r)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !requireOwnerOrAdmin(video.UserID, userID, role) {
+		respondWithError(w, http.StatusForbidden, "You can't update this video", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if params.Title != nil {
+		video.Title, err = normalizeTitle(*params.Title)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Title "+err.Error(), nil)
+			return
+		}
+	}
+	if params.Description != nil {
+		video.Description = *params.Description
+	}
+	if params.Visibility != nil {
+		if !database.ValidVisibility(*params.Visibility) {
+			respondWithError(w, http.StatusBadRequest, "Visibility must be public, unlisted or private", nil)
+			return
+		}
+		video.Visibility = *params.Visibility
+	}
+	if params.Archived != nil && *params.Archived != video.Archived {
+		video.Archived = *params.Archived
+		// move the objects first, so a failure leaves the flag as it was
+		err = cfg.applyVideoStorageClass(r.Context(), video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't change the video's storage class", err)
+			return
+		}
+	}
+
+	err = cfg.db.WithTx(func(tx database.Tx) error {
+		err := tx.UpdateVideo(video)
+		if err != nil {
+			return err
+		}
+		if params.Tags != nil {
+			return tx.SetVideoTags(videoID, *params.Tags)
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	video, err = cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+
+	video, err = cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
 		return
 	}
 
+	userID := userIDFromContext(r)
+	role := roleFromContext(r)
+
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !requireOwnerOrAdmin(video.UserID, userID, role) {
+		respondWithError(w, http.StatusForbidden, "You can't delete this video", nil)
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	err = cfg.db.SoftDeleteVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
@@ -81,11 +218,148 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// maxBulkDeleteVideos caps how many videos one bulk delete can name
+const maxBulkDeleteVideos = 100
+
+// handlerVideosBulkDelete deletes several videos at once, reporting on each.
+// Like deleting one video, it moves them to the trash unless permanent is
+// set, in which case their rows and S3 objects are removed straight away.
+func (cfg *apiConfig) handlerVideosBulkDelete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		IDs       []string `json:"ids"`
+		Permanent bool     `json:"permanent"`
+	}
+	type result struct {
+		ID      string `json:"id"`
+		Deleted bool   `json:"deleted"`
+		Error   string `json:"error,omitempty"`
+	}
+	type response struct {
+		Results []result `json:"results"`
+	}
+
+	userID := userIDFromContext(r)
+	role := roleFromContext(r)
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if len(params.IDs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No video IDs given", nil)
+		return
+	}
+	if len(params.IDs) > maxBulkDeleteVideos {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("At most %d videos can be deleted at once", maxBulkDeleteVideos), nil)
+		return
+	}
+
+	results := make([]result, len(params.IDs))
+	purged := []database.Video{}
+	for i, idString := range params.IDs {
+		results[i].ID = idString
+		videoID, err := uuid.Parse(idString)
+		if err != nil {
+			results[i].Error = "Invalid ID"
+			continue
+		}
+
+		video, err := cfg.db.GetVideo(videoID)
+		if err != nil {
+			results[i].Error = "Couldn't get video"
+			continue
+		}
+		// videos the caller can't manage are reported as missing, as they
+		// are everywhere else
+		if video.ID == uuid.Nil || !requireOwnerOrAdmin(video.UserID, userID, role) {
+			results[i].Error = "Video not found"
+			continue
+		}
+
+		if params.Permanent {
+			var uploadIDs []uuid.UUID
+			uploadIDs, err = cfg.db.DeleteVideo(videoID)
+			cfg.removeResumableUploadFiles(uploadIDs)
+		} else if video.DeletedAt == nil {
+			err = cfg.db.SoftDeleteVideo(videoID)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Couldn't delete video", "video_id", videoID, "error", err)
+			results[i].Error = "Couldn't delete video"
+			continue
+		}
+		results[i].Deleted = true
+		if params.Permanent {
+			purged = append(purged, video)
+		}
+	}
+
+	// the rows are gone either way, so a failure here only leaks storage
+	err = cfg.deleteVideoObjects(r.Context(), purged)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't delete objects for deleted videos", "error", err)
+	}
+
+	respondWithJSON(w, http.StatusOK, response{Results: results})
+}
+
+func (cfg *apiConfig) handlerVideoRestore(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	userID := userIDFromContext(r)
+	role := roleFromContext(r)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !requireOwnerOrAdmin(video.UserID, userID, role) {
+		respondWithError(w, http.StatusForbidden, "You can't restore this video", nil)
+		return
+	}
+	if video.DeletedAt == nil {
+		respondWithError(w, http.StatusBadRequest, "Video isn't deleted", nil)
+		return
+	}
+
+	err = cfg.db.RestoreVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore video", err)
+		return
+	}
+
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+
+	video, err = cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
+
 func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
 		return
 	}
 
@@ -95,26 +369,191 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if video.DeletedAt != nil && r.URL.Query().Get("include_deleted") != "true" {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	if video.DeletedAt != nil || ownerOnly(video) {
+		userID, role, ok := cfg.authenticate(w, r)
+		if !ok {
+			return
+		}
+		if !requireOwnerOrAdmin(video.UserID, userID, role) {
+			respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+			return
+		}
+	}
+
+	video.VideoURL, err = cfg.videoURLForQuality(video, r.URL.Query().Get("quality"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid quality", err)
+		return
+	}
+
+	etag, err := cfg.videoETag(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	// clients may keep the response but must check it's still current
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	video, err = cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, video)
 }
 
-func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
+// handlerPublicVideoGet serves public and unlisted videos to anyone with the
+// link, without needing an account
+func (cfg *apiConfig) handlerPublicVideoGet(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	// private videos are reported as missing so their IDs can't be probed
+	if video.ID == uuid.Nil || video.DeletedAt != nil || ownerOnly(video) || video.ProcessingStatus == database.VideoStatusRejected {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	video.VideoURL, err = cfg.videoURLForQuality(video, r.URL.Query().Get("quality"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid quality", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+
+	video, err = cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+func (cfg *apiConfig) handlerVideoView(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		ViewCount int64 `json:"view_count"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	// only videos the caller could watch count, following handlerVideoGet,
+	// so views can't be added to, or used to probe for, videos they can't see
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if ownerOnly(video) {
+		userID, role, ok := cfg.authenticate(w, r)
+		if !ok {
+			return
+		}
+		if !requireOwnerOrAdmin(video.UserID, userID, role) {
+			respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+			return
+		}
+	}
+
+	viewCount, err := cfg.db.IncrementVideoViews(videoID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record view", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		ViewCount: viewCount,
+	})
+}
+
+// parsePagination reads the limit and offset query parameters, responding
+// with a 400 and returning false when either is invalid
+func parsePagination(w http.ResponseWriter, r *http.Request) (limit, offset int, ok bool) {
+	var err error
+	limit = defaultPageLimit
+	if limitString := r.URL.Query().Get("limit"); limitString != "" {
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit", err)
+			return 0, 0, false
+		}
+		limit = min(limit, maxPageLimit)
+	}
+
+	if offsetString := r.URL.Query().Get("offset"); offsetString != "" {
+		offset, err = strconv.Atoi(offsetString)
+		if err != nil || offset < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid offset", err)
+			return 0, 0, false
+		}
+	}
+	return limit, offset, true
+}
+
+func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r)
+
+	limit, offset, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	videos, total, err := cfg.db.GetVideosPaginated(database.GetVideosParams{
+		UserID:         userID,
+		IncludeDeleted: r.URL.Query().Get("include_deleted") == "true",
+		Search:         strings.TrimSpace(r.URL.Query().Get("search")),
+		Tag:            r.URL.Query().Get("tag"),
+		Sort:           r.URL.Query().Get("sort"),
+		Limit:          limit,
+		Offset:         offset,
+	})
+	if errors.Is(err, database.ErrInvalidSort) {
+		respondWithError(w, http.StatusBadRequest, "Invalid sort, expected one of created_asc, created_desc, title_asc, duration_desc", err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, videos)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	respondWithJSON(w, http.StatusOK, cfg.dbVideosToSignedVideos(videos))
 }
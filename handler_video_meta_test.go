@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// callVideoHandler sends a request for videoID to handler, behind
+// requireAuth, as the holder of token
+func callVideoHandler(cfg *apiConfig, handler http.HandlerFunc, method string, videoID uuid.UUID, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/videos/"+videoID.String(), nil)
+	r.SetPathValue("videoID", videoID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.requireAuth(handler)(w, r)
+	return w
+}
+
+// testTokens returns access tokens for a user and an admin
+func testTokens(t *testing.T, cfg *apiConfig) map[string]string {
+	t.Helper()
+	tokens := map[string]string{}
+	for _, role := range []string{auth.RoleUser, auth.RoleAdmin} {
+		token, err := auth.MakeJWT(uuid.New(), role, cfg.jwtSecret, cfg.jwtIssuer, cfg.jwtAudience, time.Hour)
+		if err != nil {
+			t.Fatalf("MakeJWT: %v", err)
+		}
+		tokens[role] = token
+	}
+	return tokens
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	tests := []struct {
+		name    string
+		title   string
+		want    string
+		wantErr bool
+	}{
+		{"unchanged", "My video", "My video", false},
+		{"trimmed", "  My video \n", "My video", false},
+		{"whitespace collapsed", "My \t  video\n\nagain", "My video again", false},
+		{"empty", "", "", true},
+		{"only whitespace", " \t\n ", "", true},
+		{"at the length limit", strings.Repeat("a", maxTitleLength), strings.Repeat("a", maxTitleLength), false},
+		{"limit counts characters", strings.Repeat("é", maxTitleLength), strings.Repeat("é", maxTitleLength), false},
+		{"too long", strings.Repeat("a", maxTitleLength+1), "", true},
+		{"trimmed to the limit", " " + strings.Repeat("a", maxTitleLength) + " ", strings.Repeat("a", maxTitleLength), false},
+		{"control character", "My\x00video", "", true},
+		{"invalid UTF-8", "My \xff video", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeTitle(tt.title)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeTitle(%q) error = %v, want error %v", tt.title, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeTitle(%q) = %q, want %q", tt.title, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVideoMetaDeleteMissingVideo(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	for role, token := range testTokens(t, cfg) {
+		w := callVideoHandler(cfg, cfg.handlerVideoMetaDelete, http.MethodDelete, uuid.New(), token)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("as %s, status = %d %s, want 404", role, w.Code, w.Body)
+		}
+	}
+}
+
+func TestVideoRestoreMissingVideo(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	for role, token := range testTokens(t, cfg) {
+		w := callVideoHandler(cfg, cfg.handlerVideoRestore, http.MethodPost, uuid.New(), token)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("as %s, status = %d %s, want 404", role, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"time"
+)
+
+// handlerVideoOriginalGet returns a signed URL that downloads the upload as
+// it was sent, before conversion or faststart processing, when originals
+// are retained
+func (cfg *apiConfig) handlerVideoOriginalGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		URL            string     `json:"url"`
+		ExpiresAt      *time.Time `json:"expires_at"`
+		Filename       string     `json:"filename"`
+		SizeBytes      int64      `json:"size_bytes"`
+		ChecksumSHA256 string     `json:"checksum_sha256"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+	if video.OriginalURL == nil {
+		if !cfg.keepOriginals {
+			respondWithError(w, http.StatusNotFound, "Original uploads aren't retained", nil)
+			return
+		}
+		respondWithError(w, http.StatusNotFound, "Original upload wasn't retained for this video", nil)
+		return
+	}
+
+	// the uploader's filename is only sanitized for storage, so make it safe
+	// to save as like a title
+	filename := downloadFilename(video.OriginalFilename, "")
+	if video.OriginalFilename == "" {
+		filename = downloadFilename(video.Title, path.Ext(*video.OriginalURL))
+	}
+	url, expiresAt, err := cfg.signURL(withDownloadDisposition(*video.OriginalURL, filename))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign original URL", err)
+		return
+	}
+
+	resp := response{
+		URL:            url,
+		Filename:       filename,
+		SizeBytes:      video.OriginalSizeBytes,
+		ChecksumSHA256: video.OriginalChecksumSHA256,
+	}
+	// unsigned distribution URLs don't expire
+	if !expiresAt.IsZero() {
+		resp.ExpiresAt = &expiresAt
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
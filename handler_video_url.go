@@ -0,0 +1,177 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// withDownloadDisposition asks for url to be served as an attachment named
+// filename, so browsers save it rather than play it. S3 honors
+// response-content-disposition on the signed requests CloudFront makes to
+// it, provided the distribution forwards that query string.
+func withDownloadDisposition(url, filename string) string {
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	return url + "?" + neturl.Values{"response-content-disposition": {disposition}}.Encode()
+}
+
+// downloadFilename turns a title into a filename with extension that's safe
+// to save as on any OS
+func downloadFilename(title, extension string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(title))
+	name = strings.Trim(name, ". ")
+	if name == "" {
+		name = "video"
+	}
+	return name + extension
+}
+
+// handlerVideoURLGet returns a signed URL for the video file, which also
+// accepts HEAD and Range requests. With ?download=true the URL makes
+// browsers download the file instead of playing it.
+func (cfg *apiConfig) handlerVideoURLGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		URL       string     `json:"url"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		// SizeBytes saves players a HEAD request for the Content-Length.
+		// It's only known for the original file, not renditions.
+		SizeBytes int64 `json:"size_bytes,omitempty"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	userID := userIDFromContext(r)
+	role := roleFromContext(r)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if !requireOwnerOrAdmin(video.UserID, userID, role) || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	if video.ProcessingStatus == database.VideoStatusRejected {
+		respondWithError(w, http.StatusNotFound, "Video was rejected by moderation", nil)
+		return
+	}
+	if !cfg.requireVideoObject(w, r, video) {
+		return
+	}
+
+	videoURL, err := cfg.videoURLForQuality(video, r.URL.Query().Get("quality"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid quality", err)
+		return
+	}
+
+	unsignedURL := *videoURL
+	if r.URL.Query().Get("download") == "true" {
+		unsignedURL = withDownloadDisposition(unsignedURL, downloadFilename(video.Title, ".mp4"))
+	}
+	url, expiresAt, err := cfg.signURL(unsignedURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
+		return
+	}
+
+	resp := response{
+		URL: url,
+	}
+	if videoURL == video.VideoURL {
+		resp.SizeBytes = video.SizeBytes
+	}
+	// unsigned distribution URLs don't expire
+	if !expiresAt.IsZero() {
+		resp.ExpiresAt = &expiresAt
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerVideoStream redirects players to a signed URL for the video file.
+// The distribution serves Range requests itself, so seeking works once the
+// player follows the redirect. GET routes also match HEAD, letting players
+// probe Content-Length the same way.
+func (cfg *apiConfig) handlerVideoStream(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	if ownerOnly(video) {
+		userID, role, ok := cfg.authenticate(w, r)
+		if !ok {
+			return
+		}
+		if !requireOwnerOrAdmin(video.UserID, userID, role) {
+			respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+			return
+		}
+	}
+
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	if video.ProcessingStatus == database.VideoStatusRejected {
+		respondWithError(w, http.StatusNotFound, "Video was rejected by moderation", nil)
+		return
+	}
+	if !cfg.requireVideoObject(w, r, video) {
+		return
+	}
+
+	videoURL, err := cfg.videoURLForQuality(video, r.URL.Query().Get("quality"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid quality", err)
+		return
+	}
+
+	unsignedURL := *videoURL
+	if r.URL.Query().Get("download") == "true" {
+		unsignedURL = withDownloadDisposition(unsignedURL, downloadFilename(video.Title, ".mp4"))
+	}
+	url, _, err := cfg.signURL(unsignedURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
+		return
+	}
+
+	// the signed URL expires, so the redirect itself must not be cached
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.Redirect(w, r, url, http.StatusFound)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type hlsRendition struct {
+	height       int
+	videoBitrate string
+}
+
+var hlsRenditions = []hlsRendition{
+	{height: 1080, videoBitrate: "5000k"},
+	{height: 720, videoBitrate: "2800k"},
+	{height: 480, videoBitrate: "1400k"},
+}
+
+// processVideoToHLS transcodes the input into an HLS master playlist plus
+// one variant per rendition no taller than the source. It returns the
+// directory holding master.m3u8, created in tempDir, which the caller must
+// remove.
+func processVideoToHLS(ctx context.Context, inputPath, tempDir string, metadata videoMetadata) (string, error) {
+	renditions := []hlsRendition{}
+	for _, rendition := range hlsRenditions {
+		if rendition.height <= metadata.Height {
+			renditions = append(renditions, rendition)
+		}
+	}
+	if len(renditions) == 0 {
+		renditions = hlsRenditions[len(hlsRenditions)-1:]
+	}
+
+	outputDir, err := os.MkdirTemp(tempDir, "tubely-hls-")
+	if err != nil {
+		return "", err
+	}
+
+	splits := []string{}
+	scales := []string{}
+	for i, rendition := range renditions {
+		splits = append(splits, fmt.Sprintf("[v%d]", i))
+		scales = append(scales, fmt.Sprintf("[v%d]scale=w=-2:h=%d[v%dout]", i, rendition.height, i))
+	}
+	filter := fmt.Sprintf("[0:v]split=%d%s;%s", len(renditions), strings.Join(splits, ""), strings.Join(scales, ";"))
+
+	args := []string{"-i", inputPath, "-filter_complex", filter}
+	streamMap := []string{}
+	for i, rendition := range renditions {
+		args = append(args,
+			"-map", fmt.Sprintf("[v%dout]", i),
+			fmt.Sprintf("-c:v:%d", i), "libx264",
+			fmt.Sprintf("-b:v:%d", i), rendition.videoBitrate,
+		)
+		variant := fmt.Sprintf("v:%d", i)
+		if metadata.HasAudio {
+			args = append(args, "-map", "a:0")
+			variant += fmt.Sprintf(",a:%d", i)
+		}
+		streamMap = append(streamMap, variant)
+	}
+	if metadata.HasAudio {
+		args = append(args, "-c:a", "aac", "-b:a", "128k")
+	}
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outputDir, "%v", "segment%03d.ts"),
+		"-master_pl_name", "master.m3u8",
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(outputDir, "%v", "playlist.m3u8"),
+	)
+
+	command := execCommand(ctx, "ffmpeg", args...)
+	slog.DebugContext(ctx, "Running ffmpeg", "command", command.String())
+	err = command.Run()
+	if err != nil {
+		os.RemoveAll(outputDir)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+
+	return outputDir, nil
+}
+
+// uploadHLS uploads every playlist and segment in dir under keyPrefix in
+// store and returns the key of the master playlist
+func (cfg *apiConfig) uploadHLS(ctx context.Context, store *s3Store, dir, keyPrefix string, storageClass types.StorageClass) (string, error) {
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		contentType := "video/mp2t"
+		if filepath.Ext(path) == ".m3u8" {
+			contentType = "application/vnd.apple.mpegurl"
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return cfg.uploadToS3Multipart(ctx, store, keyPrefix+filepath.ToSlash(relPath), file, contentType, storageClass)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return keyPrefix + "master.m3u8", nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// keyedMutex serializes work per key, dropping each lock once nobody holds
+// or waits for it
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*keyedLock{}}
+}
+
+// lock blocks until key is free and returns the func that frees it
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.users++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		k.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// recordingResponseWriter keeps a copy of a response as it's written
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idempotent lets clients safely retry an upload by sending the same
+// Idempotency-Key header. Requests with the same user and key run one at a
+// time, and once one succeeds its response is replayed until the key
+// expires instead of processing the upload again. Failed responses aren't
+// saved, so those can be retried. It reads the caller from requireAuth, so
+// it has to be wrapped by it.
+func (cfg *apiConfig) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength), nil)
+			return
+		}
+
+		videoID, err := uuid.Parse(r.PathValue("videoID"))
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+			return
+		}
+		userID := userIDFromContext(r)
+
+		unlock := cfg.idempotencyLocks.lock(userID.String() + "/" + key)
+		defer unlock()
+
+		saved, ok, err := cfg.db.GetIdempotentResponse(userID, key)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check idempotency key", err)
+			return
+		}
+		if ok {
+			if saved.VideoID != videoID {
+				respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different video", nil)
+				return
+			}
+			w.Header().Set("Content-Type", saved.ContentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(saved.StatusCode)
+			w.Write(saved.Body)
+			return
+		}
+
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		next(rw, r)
+
+		if rw.status < 200 || rw.status > 299 {
+			return
+		}
+		err = cfg.db.SaveIdempotentResponse(database.IdempotentResponse{
+			UserID:      userID,
+			Key:         key,
+			VideoID:     videoID,
+			StatusCode:  rw.status,
+			ContentType: rw.Header().Get("Content-Type"),
+			Body:        rw.body.Bytes(),
+			ExpiresAt:   time.Now().Add(cfg.idempotencyTTL),
+		})
+		if err != nil {
+			// the upload already went through, so only a retry would notice
+			logError(w, "Couldn't save idempotent response", err)
+		}
+	}
+}
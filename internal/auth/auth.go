@@ -14,13 +14,26 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-type TokenType string
-
 const (
-	TokenTypeAccess TokenType = "tubely-access"
+	RoleUser  = "user"
+	RoleAdmin = "admin"
 )
 
+type accessClaims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// RevocationList reports whether a JWT has been revoked, either on its own
+// by its ID (jti) or along with every token issued to the user before a
+// point in time
+type RevocationList interface {
+	IsJWTRevoked(jti string) (bool, error)
+	AreUserTokensRevoked(userID uuid.UUID, issuedAt time.Time) (bool, error)
+}
 
 func HashPassword(password string) (string, error) {
 	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -36,48 +49,97 @@ func CheckPasswordHash(password, hash string) error {
 
 func MakeJWT(
 	userID uuid.UUID,
+	role string,
 	tokenSecret string,
+	issuer string,
+	audience string,
 	expiresIn time.Duration,
 ) (string, error) {
 	signingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   userID.String(),
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   userID.String(),
+			ID:        uuid.NewString(),
+		},
 	})
 	return token.SignedString(signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
+// ValidateJWT returns the user ID and role the token was issued for. Tokens
+// must carry the expected issuer and audience.
+func ValidateJWT(tokenString, tokenSecret, issuer, audience string, revoked RevocationList) (uuid.UUID, string, error) {
+	claimsStruct := accessClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(audience),
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, "", err
 	}
 
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, "", err
+	}
+
+	if claimsStruct.ID != "" {
+		isRevoked, err := revoked.IsJWTRevoked(claimsStruct.ID)
+		if err != nil {
+			return uuid.Nil, "", err
+		}
+		if isRevoked {
+			return uuid.Nil, "", ErrTokenRevoked
+		}
 	}
 
-	issuer, err := token.Claims.GetIssuer()
+	id, err := uuid.Parse(userIDString)
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, "", fmt.Errorf("invalid user ID: %w", err)
 	}
-	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+
+	if claimsStruct.IssuedAt != nil {
+		isRevoked, err := revoked.AreUserTokensRevoked(id, claimsStruct.IssuedAt.Time)
+		if err != nil {
+			return uuid.Nil, "", err
+		}
+		if isRevoked {
+			return uuid.Nil, "", ErrTokenRevoked
+		}
 	}
 
-	id, err := uuid.Parse(userIDString)
+	role := claimsStruct.Role
+	if role == "" {
+		role = RoleUser
+	}
+	return id, role, nil
+}
+
+// GetJWTID returns the ID (jti) and expiry of a token signed with tokenSecret
+func GetJWTID(tokenString, tokenSecret string) (string, time.Time, error) {
+	claimsStruct := jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		&claimsStruct,
+		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+	)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return "", time.Time{}, err
+	}
+	if claimsStruct.ID == "" {
+		return "", time.Time{}, errors.New("token has no ID")
+	}
+	if claimsStruct.ExpiresAt == nil {
+		return "", time.Time{}, errors.New("token has no expiry")
 	}
-	return id, nil
+	return claimsStruct.ID, claimsStruct.ExpiresAt.Time, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -94,6 +156,22 @@ func GetBearerToken(headers http.Header) (string, error) {
 }
 
 func MakeRefreshToken() (string, error) {
+	return randomToken()
+}
+
+// MakeEmailVerificationToken returns a token for the link that proves a user
+// owns their email address
+func MakeEmailVerificationToken() (string, error) {
+	return randomToken()
+}
+
+// MakePasswordResetToken returns a single use token for resetting a
+// forgotten password
+func MakePasswordResetToken() (string, error) {
+	return randomToken()
+}
+
+func randomToken() (string, error) {
 	token := make([]byte, 32)
 	_, err := rand.Read(token)
 	if err != nil {
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// noRevocations is a RevocationList with nothing revoked
+type noRevocations struct{}
+
+func (noRevocations) IsJWTRevoked(jti string) (bool, error) { return false, nil }
+
+func (noRevocations) AreUserTokensRevoked(userID uuid.UUID, issuedAt time.Time) (bool, error) {
+	return false, nil
+}
+
+func TestValidateJWT(t *testing.T) {
+	userID := uuid.New()
+	token, err := MakeJWT(userID, RoleAdmin, "secret", "tubely", "tubely-api", time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+
+	gotID, gotRole, err := ValidateJWT(token, "secret", "tubely", "tubely-api", noRevocations{})
+	if err != nil {
+		t.Fatalf("ValidateJWT: %v", err)
+	}
+	if gotID != userID || gotRole != RoleAdmin {
+		t.Errorf("ValidateJWT = %v, %q, want %v, %q", gotID, gotRole, userID, RoleAdmin)
+	}
+
+	_, _, err = ValidateJWT(token, "other secret", "tubely", "tubely-api", noRevocations{})
+	if err == nil {
+		t.Error("ValidateJWT accepted a token signed with another secret")
+	}
+}
+
+func TestValidateJWTIssuerAndAudience(t *testing.T) {
+	tests := []struct {
+		name     string
+		issuer   string
+		audience string
+		want     error
+	}{
+		{"wrong issuer", "other-service", "tubely-api", jwt.ErrTokenInvalidIssuer},
+		{"wrong audience", "tubely", "other-api", jwt.ErrTokenInvalidAudience},
+		{"no issuer", "", "tubely-api", jwt.ErrTokenRequiredClaimMissing},
+		{"no audience", "tubely", "", jwt.ErrTokenRequiredClaimMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := MakeJWT(uuid.New(), RoleUser, "secret", tt.issuer, tt.audience, time.Hour)
+			if err != nil {
+				t.Fatalf("MakeJWT: %v", err)
+			}
+
+			_, _, err = ValidateJWT(token, "secret", "tubely", "tubely-api", noRevocations{})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("ValidateJWT error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateJWTExpired(t *testing.T) {
+	token, err := MakeJWT(uuid.New(), RoleUser, "secret", "tubely", "tubely-api", time.Second)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+
+	// expiry is stored in whole seconds, so wait past the next one
+	time.Sleep(2 * time.Second)
+
+	_, _, err = ValidateJWT(token, "secret", "tubely", "tubely-api", noRevocations{})
+	if !errors.Is(err, jwt.ErrTokenExpired) {
+		t.Errorf("ValidateJWT error = %v, want %v", err, jwt.ErrTokenExpired)
+	}
+}
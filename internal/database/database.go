@@ -1,9 +1,11 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
+	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -21,10 +23,21 @@ func NewClient(pathToDB string) (Client, error) {
 	if err != nil {
 		return Client{}, err
 	}
+	err = c.migrate()
+	if err != nil {
+		return Client{}, err
+	}
 	return c, nil
 
 }
 
+func (c Client) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
+// autoMigrate creates the baseline schema and adds the columns older
+// databases are missing. It's safe to run on every start; later changes go
+// in migrations instead.
 func (c *Client) autoMigrate() error {
 	userTable := `
 	CREATE TABLE IF NOT EXISTS users (
@@ -32,13 +45,62 @@ func (c *Client) autoMigrate() error {
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		password TEXT NOT NULL,
-		email TEXT UNIQUE NOT NULL
+		email TEXT UNIQUE NOT NULL,
+		role TEXT NOT NULL DEFAULT 'user',
+		email_verified INTEGER NOT NULL DEFAULT 0,
+		tokens_valid_after TIMESTAMP,
+		region TEXT NOT NULL DEFAULT ''
 	);
 	`
 	_, err := c.db.Exec(userTable)
 	if err != nil {
 		return err
 	}
+	err = c.addColumnIfNotExists("users", "role", "TEXT NOT NULL DEFAULT 'user'")
+	if err != nil {
+		return err
+	}
+	err = c.addEmailVerifiedColumn()
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "tokens_valid_after", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "region", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	emailVerificationTokenTable := `
+	CREATE TABLE IF NOT EXISTS email_verification_tokens (
+		token TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(emailVerificationTokenTable)
+	if err != nil {
+		return err
+	}
+
+	passwordResetTokenTable := `
+	CREATE TABLE IF NOT EXISTS password_reset_tokens (
+		token TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(passwordResetTokenTable)
+	if err != nil {
+		return err
+	}
+
 	refreshTokenTable := `
 	CREATE TABLE IF NOT EXISTS refresh_tokens (
 		token TEXT PRIMARY KEY,
@@ -55,6 +117,18 @@ func (c *Client) autoMigrate() error {
 		return err
 	}
 
+	revokedJWTTable := `
+	CREATE TABLE IF NOT EXISTS revoked_jwts (
+		jti TEXT PRIMARY KEY,
+		revoked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(revokedJWTTable)
+	if err != nil {
+		return err
+	}
+
 	videoTable := `
 	CREATE TABLE IF NOT EXISTS videos (
 		id TEXT PRIMARY KEY,
@@ -65,6 +139,25 @@ func (c *Client) autoMigrate() error {
 		thumbnail_url TEXT,
 		video_url TEXT TEXT,
 		user_id INTEGER,
+		size_bytes INTEGER NOT NULL DEFAULT 0,
+		duration_seconds REAL NOT NULL DEFAULT 0,
+		codec TEXT NOT NULL DEFAULT '',
+		deleted_at TIMESTAMP,
+		hls_url TEXT,
+		resolutions TEXT NOT NULL DEFAULT '',
+		view_count INTEGER NOT NULL DEFAULT 0,
+		upload_key TEXT,
+		processing_status TEXT NOT NULL DEFAULT '',
+		processing_error TEXT NOT NULL DEFAULT '',
+		visibility TEXT NOT NULL DEFAULT 'private',
+		original_filename TEXT NOT NULL DEFAULT '',
+		captions TEXT NOT NULL DEFAULT '{}',
+		sprite_url TEXT,
+		sprite_index_url TEXT,
+		faststart INTEGER NOT NULL DEFAULT 0,
+		archived INTEGER NOT NULL DEFAULT 0,
+		checksum_sha256 TEXT NOT NULL DEFAULT '',
+		region TEXT NOT NULL DEFAULT '',
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);
 	`
@@ -72,18 +165,251 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	videoTagTable := `
+	CREATE TABLE IF NOT EXISTS video_tags (
+		video_id TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY(video_id, tag),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoTagTable)
+	if err != nil {
+		return err
+	}
+
+	idempotencyKeyTable := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		status_code INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		body BLOB NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		PRIMARY KEY(user_id, key)
+	);
+	`
+	_, err = c.db.Exec(idempotencyKeyTable)
+	if err != nil {
+		return err
+	}
+
+	shareLinkTable := `
+	CREATE TABLE IF NOT EXISTS share_links (
+		token TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(shareLinkTable)
+	if err != nil {
+		return err
+	}
+
+	resumableUploadTable := `
+	CREATE TABLE IF NOT EXISTS resumable_uploads (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		filename TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(resumableUploadTable)
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "size_bytes", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "duration_seconds", "REAL NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "codec", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "deleted_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "hls_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "resolutions", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "view_count", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "upload_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "processing_status", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "processing_error", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "visibility", "TEXT NOT NULL DEFAULT 'private'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "original_filename", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "captions", "TEXT NOT NULL DEFAULT '{}'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "sprite_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "sprite_index_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "faststart", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "archived", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "checksum_sha256", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "region", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// addEmailVerifiedColumn adds users.email_verified, marking the accounts
+// that already exist as verified, since they signed up before verification
+// was asked for. Only new signups start out unverified.
+func (c *Client) addEmailVerifiedColumn() error {
+	exists, err := c.hasColumn("users", "email_verified")
+	if err != nil || exists {
+		return err
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return fmt.Errorf("failed to add column users.email_verified: %w", err)
+	}
+	_, err = tx.Exec("UPDATE users SET email_verified = 1")
+	if err != nil {
+		return fmt.Errorf("failed to backfill users.email_verified: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (c *Client) addColumnIfNotExists(table, column, definition string) error {
+	exists, err := c.hasColumn(table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
-func (c Client) Reset() error {
+func (c *Client) hasColumn(table, column string) (bool, error) {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid          int
+			name         string
+			columnType   string
+			notNull      bool
+			defaultValue sql.NullString
+			primaryKey   int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// Reset empties every table and returns the IDs of the resumable uploads it
+// deleted, so their temp files can be removed
+func (c Client) Reset() ([]uuid.UUID, error) {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
-		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
+		return nil, fmt.Errorf("failed to reset table refresh_tokens: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM revoked_jwts"); err != nil {
+		return nil, fmt.Errorf("failed to reset table revoked_jwts: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM password_reset_tokens"); err != nil {
+		return nil, fmt.Errorf("failed to reset table password_reset_tokens: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM email_verification_tokens"); err != nil {
+		return nil, fmt.Errorf("failed to reset table email_verification_tokens: %w", err)
 	}
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
-		return fmt.Errorf("failed to reset table users: %w", err)
+		return nil, fmt.Errorf("failed to reset table users: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM idempotency_keys"); err != nil {
+		return nil, fmt.Errorf("failed to reset table idempotency_keys: %w", err)
+	}
+	rows, err := c.db.Query("DELETE FROM resumable_uploads RETURNING id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to reset table resumable_uploads: %w", err)
+	}
+	uploadIDs, err := scanUploadIDs(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reset table resumable_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM share_links"); err != nil {
+		return nil, fmt.Errorf("failed to reset table share_links: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_tags"); err != nil {
+		return nil, fmt.Errorf("failed to reset table video_tags: %w", err)
 	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
-		return fmt.Errorf("failed to reset table videos: %w", err)
+		return nil, fmt.Errorf("failed to reset table videos: %w", err)
 	}
-	return nil
+	return uploadIDs, nil
 }
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type CreateEmailVerificationTokenParams struct {
+	Token     string
+	UserID    uuid.UUID
+	ExpiresAt time.Time
+}
+
+func (c Client) CreateEmailVerificationToken(params CreateEmailVerificationTokenParams) error {
+	query := `
+		INSERT INTO email_verification_tokens (
+			token,
+			user_id,
+			created_at,
+			expires_at
+		) VALUES (?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	return err
+}
+
+// VerifyEmail marks the token's user as verified and uses up all of their
+// tokens. It returns the user's ID, or uuid.Nil if the token doesn't exist
+// or has expired.
+func (c Client) VerifyEmail(token string) (uuid.UUID, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	var userIDString string
+	err = tx.QueryRow(`
+		SELECT user_id
+		FROM email_verification_tokens
+		WHERE token = ?
+		AND expires_at > ?
+	`, token, time.Now().UTC()).Scan(&userIDString)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, nil
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	userID, err := uuid.Parse(userIDString)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM email_verification_tokens WHERE user_id = ?", userIDString)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	_, err = tx.Exec(`
+		UPDATE users
+		SET email_verified = 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, userIDString)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return userID, tx.Commit()
+}
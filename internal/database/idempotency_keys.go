@@ -0,0 +1,68 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotentResponse is a stored response replayed for a repeated request
+type IdempotentResponse struct {
+	UserID      uuid.UUID
+	Key         string
+	VideoID     uuid.UUID
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+func (c Client) SaveIdempotentResponse(resp IdempotentResponse) error {
+	query := `
+		INSERT OR REPLACE INTO idempotency_keys (
+			user_id,
+			key,
+			video_id,
+			status_code,
+			content_type,
+			body,
+			created_at,
+			expires_at
+		) VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	_, err := c.db.Exec(query, resp.UserID, resp.Key, resp.VideoID, resp.StatusCode, resp.ContentType, resp.Body, resp.ExpiresAt.UTC())
+	return err
+}
+
+// GetIdempotentResponse returns the unexpired response saved for the user's
+// key, or false if there isn't one
+func (c Client) GetIdempotentResponse(userID uuid.UUID, key string) (IdempotentResponse, bool, error) {
+	query := `
+		SELECT user_id, key, video_id, status_code, content_type, body, expires_at
+		FROM idempotency_keys
+		WHERE user_id = ? AND key = ? AND expires_at > ?
+	`
+	var resp IdempotentResponse
+	err := c.db.QueryRow(query, userID, key, time.Now().UTC()).
+		Scan(&resp.UserID, &resp.Key, &resp.VideoID, &resp.StatusCode, &resp.ContentType, &resp.Body, &resp.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return IdempotentResponse{}, false, nil
+	}
+	if err != nil {
+		return IdempotentResponse{}, false, err
+	}
+	return resp, true, nil
+}
+
+func (c Client) PruneIdempotencyKeys() (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expires_at < ?
+	`
+	result, err := c.db.Exec(query, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles are the versioned schema changes, named like
+// 0002_add_video_language.sql. They run in version order, once each, after
+// autoMigrate has brought the tables to the baseline schema. Applied
+// migrations are never edited; a change needs a new file.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations reads the embedded migrations, sorted by version
+func loadMigrations() ([]migration, error) {
+	paths, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []migration{}
+	for _, p := range paths {
+		name := strings.TrimSuffix(path.Base(p), ".sql")
+		versionString, _, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(versionString)
+		if !ok || err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s must be named <version>_<description>.sql", path.Base(p))
+		}
+		contents, err := migrationFiles.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(contents)})
+	}
+
+	slices.SortFunc(migrations, func(a, b migration) int { return a.version - b.version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", migrations[i-1].name, migrations[i].name, migrations[i].version)
+		}
+	}
+	return migrations, nil
+}
+
+// migrate applies the migrations that haven't run yet. Each runs in its own
+// transaction along with the row recording it, so a failed migration leaves
+// nothing behind and is tried again on the next start.
+func (c *Client) migrate() error {
+	_, err := c.db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	rows, err := c.db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		err := c.applyMigration(m)
+		if err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) applyMigration(m migration) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(m.sql)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
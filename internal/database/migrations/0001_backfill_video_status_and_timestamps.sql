@@ -0,0 +1,6 @@
+-- videos uploaded before processing was tracked are already done
+UPDATE videos SET processing_status = 'ready' WHERE processing_status = '' AND video_url IS NOT NULL;
+
+-- rows written before the timestamps were kept get the best guess there is
+UPDATE videos SET created_at = COALESCE(created_at, updated_at, CURRENT_TIMESTAMP) WHERE created_at IS NULL;
+UPDATE videos SET updated_at = created_at WHERE updated_at IS NULL;
@@ -0,0 +1,4 @@
+-- the untouched upload, kept when KEEP_ORIGINALS is set
+ALTER TABLE videos ADD COLUMN original_url TEXT;
+ALTER TABLE videos ADD COLUMN original_size_bytes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE videos ADD COLUMN original_checksum_sha256 TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type CreatePasswordResetTokenParams struct {
+	Token     string
+	UserID    uuid.UUID
+	ExpiresAt time.Time
+}
+
+func (c Client) CreatePasswordResetToken(params CreatePasswordResetTokenParams) error {
+	query := `
+		INSERT INTO password_reset_tokens (
+			token,
+			user_id,
+			created_at,
+			expires_at
+		) VALUES (?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	return err
+}
+
+// ResetPassword sets the password of the token's user and signs them out
+// everywhere: their reset tokens are used up, their refresh tokens revoked
+// and every access token issued so far rejected. It returns the user's ID,
+// or uuid.Nil if the token doesn't exist or has expired.
+func (c Client) ResetPassword(token, hashedPassword string) (uuid.UUID, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var userIDString string
+	err = tx.QueryRow(`
+		SELECT user_id
+		FROM password_reset_tokens
+		WHERE token = ?
+		AND expires_at > ?
+	`, token, now).Scan(&userIDString)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, nil
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	userID, err := uuid.Parse(userIDString)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM password_reset_tokens WHERE user_id = ?", userIDString)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	// JWT issue times are truncated to the second, so this is too, keeping a
+	// login made straight after the reset valid
+	_, err = tx.Exec(`
+		UPDATE users
+		SET password = ?, tokens_valid_after = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, hashedPassword, now.Truncate(time.Second), userIDString)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	_, err = tx.Exec(`
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = ?
+		AND revoked_at IS NULL
+	`, userIDString)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return userID, tx.Commit()
+}
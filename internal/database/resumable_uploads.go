@@ -0,0 +1,122 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ResumableUpload is an upload sent in chunks. The bytes received so far are
+// kept in a temp file, so only the declared size is stored here.
+type ResumableUpload struct {
+	ID        uuid.UUID `json:"id"`
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	SizeBytes int64     `json:"size_bytes"`
+	Filename  string    `json:"filename"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CreateResumableUploadParams struct {
+	VideoID   uuid.UUID
+	UserID    uuid.UUID
+	SizeBytes int64
+	Filename  string
+}
+
+func (c Client) CreateResumableUpload(params CreateResumableUploadParams) (ResumableUpload, error) {
+	id := uuid.New()
+	query := `
+		INSERT INTO resumable_uploads (
+			id,
+			video_id,
+			user_id,
+			size_bytes,
+			filename,
+			created_at,
+			updated_at
+		) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.UserID, params.SizeBytes, params.Filename)
+	if err != nil {
+		return ResumableUpload{}, err
+	}
+
+	return c.GetResumableUpload(id)
+}
+
+// GetResumableUpload returns a zero ResumableUpload if the ID doesn't exist
+func (c Client) GetResumableUpload(id uuid.UUID) (ResumableUpload, error) {
+	query := `
+		SELECT id, video_id, user_id, size_bytes, filename, created_at, updated_at
+		FROM resumable_uploads
+		WHERE id = ?
+	`
+	var upload ResumableUpload
+	err := c.db.QueryRow(query, id).Scan(
+		&upload.ID,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.SizeBytes,
+		&upload.Filename,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return ResumableUpload{}, nil
+	}
+	if err != nil {
+		return ResumableUpload{}, err
+	}
+	return upload, nil
+}
+
+// TouchResumableUpload records that a chunk arrived, which keeps the upload
+// from being garbage collected
+func (c Client) TouchResumableUpload(id uuid.UUID) error {
+	_, err := c.db.Exec("UPDATE resumable_uploads SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+	return err
+}
+
+func (c Client) DeleteResumableUpload(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM resumable_uploads WHERE id = ?", id)
+	return err
+}
+
+// DeleteStaleResumableUploads removes uploads that haven't received a chunk
+// within maxAge and returns their IDs, so their temp files can be removed
+func (c Client) DeleteStaleResumableUploads(maxAge time.Duration) ([]uuid.UUID, error) {
+	cutoff := fmt.Sprintf("-%d seconds", int64(maxAge.Seconds()))
+	query := `
+		DELETE FROM resumable_uploads
+		WHERE updated_at < datetime('now', ?)
+		RETURNING id
+	`
+	rows, err := c.db.Query(query, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	return scanUploadIDs(rows)
+}
+
+// scanUploadIDs reads the ids a DELETE ... RETURNING id gave back
+func scanUploadIDs(rows *sql.Rows) ([]uuid.UUID, error) {
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
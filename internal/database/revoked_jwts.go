@@ -0,0 +1,69 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (c Client) RevokeJWT(jti string, expiresAt time.Time) error {
+	query := `
+		INSERT OR IGNORE INTO revoked_jwts (
+			jti,
+			revoked_at,
+			expires_at
+		) VALUES (?, CURRENT_TIMESTAMP, ?)
+	`
+	_, err := c.db.Exec(query, jti, expiresAt.UTC())
+	return err
+}
+
+func (c Client) IsJWTRevoked(jti string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM revoked_jwts
+			WHERE jti = ?
+		)
+	`
+	var revoked bool
+	err := c.db.QueryRow(query, jti).Scan(&revoked)
+	if err != nil {
+		return false, err
+	}
+	return revoked, nil
+}
+
+// AreUserTokensRevoked reports whether a token issued to the user at
+// issuedAt predates the last time all their tokens were invalidated, such as
+// by a password reset
+func (c Client) AreUserTokensRevoked(userID uuid.UUID, issuedAt time.Time) (bool, error) {
+	query := `
+		SELECT tokens_valid_after
+		FROM users
+		WHERE id = ?
+	`
+	var validAfter *time.Time
+	err := c.db.QueryRow(query, userID.String()).Scan(&validAfter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return validAfter != nil && issuedAt.Before(*validAfter), nil
+}
+
+// PruneRevokedJWTs removes revocations for tokens that have expired anyway
+func (c Client) PruneRevokedJWTs() (int64, error) {
+	query := `
+		DELETE FROM revoked_jwts
+		WHERE expires_at < ?
+	`
+	result, err := c.db.Exec(query, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ShareLink struct {
+	CreateShareLinkParams
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+type CreateShareLinkParams struct {
+	Token     string    `json:"token"`
+	VideoID   uuid.UUID `json:"video_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (c Client) CreateShareLink(params CreateShareLinkParams) (ShareLink, error) {
+	query := `
+		INSERT INTO share_links (
+			token,
+			video_id,
+			created_at,
+			expires_at
+		) VALUES (?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	_, err := c.db.Exec(query, params.Token, params.VideoID, params.ExpiresAt)
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	return c.GetShareLink(params.Token)
+}
+
+// GetShareLink returns a zero ShareLink if the token doesn't exist
+func (c Client) GetShareLink(token string) (ShareLink, error) {
+	query := `
+		SELECT token, video_id, created_at, expires_at, revoked_at
+		FROM share_links
+		WHERE token = ?
+	`
+	var link ShareLink
+	err := c.db.QueryRow(query, token).
+		Scan(&link.Token, &link.VideoID, &link.CreatedAt, &link.ExpiresAt, &link.RevokedAt)
+	if err == sql.ErrNoRows {
+		return ShareLink{}, nil
+	}
+	if err != nil {
+		return ShareLink{}, err
+	}
+	return link, nil
+}
+
+// GetActiveShareLinks lists a video's links that are neither revoked nor
+// expired, newest first
+func (c Client) GetActiveShareLinks(videoID uuid.UUID) ([]ShareLink, error) {
+	query := `
+		SELECT token, video_id, created_at, expires_at, revoked_at
+		FROM share_links
+		WHERE video_id = ?
+		AND revoked_at IS NULL
+		AND expires_at > ?
+		ORDER BY created_at DESC
+	`
+	rows, err := c.db.Query(query, videoID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		var link ShareLink
+		err := rows.Scan(&link.Token, &link.VideoID, &link.CreatedAt, &link.ExpiresAt, &link.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// RevokeShareLink reports whether the video had an active link with that token
+func (c Client) RevokeShareLink(videoID uuid.UUID, token string) (bool, error) {
+	query := `
+		UPDATE share_links
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE token = ? AND video_id = ? AND revoked_at IS NULL
+	`
+	result, err := c.db.Exec(query, token, videoID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// normalizeTags trims and lowercases tags, dropping empty and duplicate
+// ones. Commas separate tags, since tags are read back comma separated.
+func normalizeTags(tags []string) []string {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, tag := range tags {
+		for _, part := range strings.Split(tag, ",") {
+			part = strings.ToLower(strings.TrimSpace(part))
+			if part == "" || seen[part] {
+				continue
+			}
+			seen[part] = true
+			normalized = append(normalized, part)
+		}
+	}
+	return normalized
+}
+
+func (c Client) SetVideoTags(videoID uuid.UUID, tags []string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = setVideoTags(tx, videoID, tags)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func setVideoTags(tx *sql.Tx, videoID uuid.UUID, tags []string) error {
+	_, err := tx.Exec("DELETE FROM video_tags WHERE video_id = ?", videoID)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range normalizeTags(tags) {
+		_, err = tx.Exec("INSERT INTO video_tags (video_id, tag) VALUES (?, ?)", videoID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/google/uuid"
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so a write can run on
+// its own or as part of a transaction
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// Tx exposes the writes that can be grouped with WithTx
+type Tx struct {
+	tx *sql.Tx
+}
+
+func (t Tx) UpdateVideo(video Video) error {
+	return updateVideo(t.tx, video)
+}
+
+func (t Tx) SetVideoProcessingStatus(id uuid.UUID, status, processingError string) error {
+	return setVideoProcessingStatus(t.tx, id, status, processingError)
+}
+
+func (t Tx) SetVideoTags(videoID uuid.UUID, tags []string) error {
+	return setVideoTags(t.tx, videoID, tags)
+}
+
+// WithTx runs fn in a transaction, committing only if it returns nil
+func (c Client) WithTx(fn func(tx Tx) error) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(Tx{tx: tx})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IntList is stored as a comma separated TEXT column
+type IntList []int
+
+func (l IntList) Value() (driver.Value, error) {
+	parts := make([]string, len(l))
+	for i, n := range l {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func (l *IntList) Scan(src any) error {
+	var text string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("can't scan %T into IntList", src)
+	}
+
+	*l = IntList{}
+	if text == "" {
+		return nil
+	}
+	for _, part := range strings.Split(text, ",") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return fmt.Errorf("invalid IntList element %q: %w", part, err)
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+// StringList scans a comma separated TEXT column, such as the result of
+// group_concat
+type StringList []string
+
+func (l *StringList) Scan(src any) error {
+	var text string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("can't scan %T into StringList", src)
+	}
+
+	*l = StringList{}
+	if text == "" {
+		return nil
+	}
+	*l = strings.Split(text, ",")
+	return nil
+}
+
+// StringMap is stored as a JSON object in a TEXT column
+type StringMap map[string]string
+
+func (m StringMap) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (m *StringMap) Scan(src any) error {
+	var text []byte
+	switch v := src.(type) {
+	case nil:
+	case string:
+		text = []byte(v)
+	case []byte:
+		text = v
+	default:
+		return fmt.Errorf("can't scan %T into StringMap", src)
+	}
+
+	*m = StringMap{}
+	if len(text) == 0 {
+		return nil
+	}
+	return json.Unmarshal(text, m)
+}
@@ -12,19 +12,26 @@ type User struct {
 	ID        uuid.UUID `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	Role      string    `json:"role"`
+	// EmailVerified is set once the user follows the link emailed to them
+	EmailVerified bool `json:"email_verified"`
 	CreateUserParams
 }
 
 type CreateUserParams struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Region picks the bucket the user's videos are stored in. Empty means
+	// the default bucket.
+	Region string `json:"region"`
 }
 
 func (c Client) GetUsers() ([]User, error) {
 	query := `
 		SELECT
 			id,
-			email
+			email,
+			role
 		FROM users
 	`
 
@@ -38,7 +45,7 @@ func (c Client) GetUsers() ([]User, error) {
 	for rows.Next() {
 		var user User
 		var id string
-		if err := rows.Scan(&id, &user.Email); err != nil {
+		if err := rows.Scan(&id, &user.Email, &user.Role); err != nil {
 			return nil, err
 		}
 		user.ID, err = uuid.Parse(id)
@@ -53,13 +60,13 @@ func (c Client) GetUsers() ([]User, error) {
 
 func (c Client) GetUserByEmail(email string) (User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, email, password, role, email_verified, region
 		FROM users
 		WHERE email = ?
 	`
 	var user User
 	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.Role, &user.EmailVerified, &user.Region)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return User{}, nil
@@ -75,7 +82,7 @@ func (c Client) GetUserByEmail(email string) (User, error) {
 
 func (c Client) GetUserByRefreshToken(token string) (*User, error) {
 	query := `
-		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
+		SELECT u.id, u.email, u.created_at, u.updated_at, u.password, u.role, u.email_verified, u.region
 		FROM users u
 		JOIN refresh_tokens rt ON u.id = rt.user_id
 		WHERE rt.token = ?
@@ -83,7 +90,7 @@ func (c Client) GetUserByRefreshToken(token string) (*User, error) {
 
 	var user User
 	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
+	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password, &user.Role, &user.EmailVerified, &user.Region)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -103,11 +110,11 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 
 	query := `
 		INSERT INTO users
-		    (id, created_at, updated_at, email, password)
+		    (id, created_at, updated_at, email, password, region)
 		VALUES
-		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id.String(), params.Email, params.Password)
+	_, err := c.db.Exec(query, id.String(), params.Email, params.Password, params.Region)
 	if err != nil {
 		return nil, err
 	}
@@ -117,13 +124,13 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 
 func (c Client) GetUser(id uuid.UUID) (*User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, email, password, role, email_verified, region
 		FROM users
 		WHERE id = ?
 	`
 	var user User
 	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.Role, &user.EmailVerified, &user.Region)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -145,3 +152,30 @@ func (c Client) DeleteUser(id uuid.UUID) error {
 	_, err := c.db.Exec(query, id.String())
 	return err
 }
+
+// GetStorageRegions returns every region, other than the default, that a
+// user or video is stored in
+func (c Client) GetStorageRegions() ([]string, error) {
+	query := `
+		SELECT region FROM users WHERE region != ''
+		UNION
+		SELECT region FROM videos WHERE region != ''
+		ORDER BY region
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	regions := []string{}
+	for rows.Next() {
+		var region string
+		err := rows.Scan(&region)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, region)
+	}
+	return regions, rows.Err()
+}
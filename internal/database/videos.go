@@ -3,6 +3,8 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,18 +16,98 @@ type Video struct {
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
 	VideoURL     *string   `json:"video_url"`
+	HLSURL       *string   `json:"hls_url"`
+	// SpriteURL is a sheet of preview frames for the scrubber, indexed by the
+	// WebVTT track at SpriteIndexURL
+	SpriteURL      *string `json:"sprite_url"`
+	SpriteIndexURL *string `json:"sprite_index_url"`
+	// Captions maps language codes to WebVTT track URLs
+	Captions StringMap `json:"captions"`
+	// Resolutions lists the heights available for playback. The tallest is
+	// the original upload at VideoURL; the rest are transcoded renditions.
+	Resolutions     IntList `json:"resolutions"`
+	SizeBytes       int64   `json:"size_bytes"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Codec           string  `json:"codec"`
+	// OriginalFilename is the name of the file the user uploaded
+	OriginalFilename string     `json:"original_filename"`
+	ViewCount        int64      `json:"view_count"`
+	DeletedAt        *time.Time `json:"deleted_at"`
+	// UploadKey is the S3 key a browser was given to upload to directly,
+	// set while ProcessingStatus is pending
+	UploadKey        *string `json:"-"`
+	ProcessingStatus string  `json:"processing_status"`
+	// ProcessingError explains why processing failed
+	ProcessingError string `json:"processing_error,omitempty"`
+	// FastStart is set once the file has been rewritten with its moov atom
+	// at the front, so playback can start before the download finishes
+	FastStart bool `json:"faststart"`
+	// Archived videos are stored in the cheaper archive storage class
+	Archived bool `json:"archived"`
+	// ChecksumSHA256 is the hex SHA-256 of the file at VideoURL, so clients
+	// can check what they downloaded
+	ChecksumSHA256 string `json:"checksum_sha256,omitempty"`
+	// OriginalURL is the upload exactly as it was sent, before any
+	// conversion or faststart processing. It's only kept when originals are
+	// retained and is served through its own endpoint.
+	OriginalURL            *string `json:"-"`
+	OriginalSizeBytes      int64   `json:"-"`
+	OriginalChecksumSHA256 string  `json:"-"`
 	CreateVideoParams
 }
 
+// Processing statuses. A video that has never had an upload has no status.
+const (
+	// VideoStatusPending marks a video waiting for a direct upload to be
+	// finalized
+	VideoStatusPending    = "pending"
+	VideoStatusProcessing = "processing"
+	VideoStatusReady      = "ready"
+	VideoStatusFailed     = "failed"
+	// VideoStatusUnderReview marks a video moderation flagged for a person
+	// to look at. Only its owner and admins can watch it meanwhile.
+	VideoStatusUnderReview = "under_review"
+	// VideoStatusRejected marks a video moderation turned down, which is
+	// never served
+	VideoStatusRejected = "rejected"
+	// VideoStatusMissing marks a ready video whose file has gone from S3
+	VideoStatusMissing = "missing"
+)
+
+// Video visibilities. Public and unlisted videos can be watched without an
+// account; only public ones are meant to be discoverable.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+func ValidProcessingStatus(status string) bool {
+	switch status {
+	case VideoStatusPending, VideoStatusProcessing, VideoStatusReady, VideoStatusFailed,
+		VideoStatusUnderReview, VideoStatusRejected, VideoStatusMissing:
+		return true
+	}
+	return false
+}
+
+func ValidVisibility(visibility string) bool {
+	return visibility == VisibilityPublic || visibility == VisibilityUnlisted || visibility == VisibilityPrivate
+}
+
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	UserID      uuid.UUID  `json:"user_id"`
+	Tags        StringList `json:"tags"`
+	// Visibility defaults to private when empty
+	Visibility string `json:"visibility"`
+	// Region picks the bucket the video's files are stored in, taken from
+	// its owner when it's created. Empty means the default bucket.
+	Region string `json:"region"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,41 +115,321 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		user_id,
+		size_bytes,
+		duration_seconds,
+		codec,
+		deleted_at,
+		hls_url,
+		resolutions,
+		view_count,
+		upload_key,
+		processing_status,
+		processing_error,
+		visibility,
+		original_filename,
+		captions,
+		sprite_url,
+		sprite_index_url,
+		faststart,
+		archived,
+		checksum_sha256,
+		region,
+		original_url,
+		original_size_bytes,
+		original_checksum_sha256,
+		(
+			SELECT group_concat(tag, ',')
+			FROM (SELECT tag FROM video_tags WHERE video_id = videos.id ORDER BY tag)
+		)`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&video.SizeBytes,
+		&video.DurationSeconds,
+		&video.Codec,
+		&video.DeletedAt,
+		&video.HLSURL,
+		&video.Resolutions,
+		&video.ViewCount,
+		&video.UploadKey,
+		&video.ProcessingStatus,
+		&video.ProcessingError,
+		&video.Visibility,
+		&video.OriginalFilename,
+		&video.Captions,
+		&video.SpriteURL,
+		&video.SpriteIndexURL,
+		&video.FastStart,
+		&video.Archived,
+		&video.ChecksumSHA256,
+		&video.Region,
+		&video.OriginalURL,
+		&video.OriginalSizeBytes,
+		&video.OriginalChecksumSHA256,
+		&video.Tags,
+	)
+	return video, err
+}
+
+func scanVideos(rows *sql.Rows) ([]Video, error) {
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return videos, nil
+}
+
+func (c Client) GetVideos(userID uuid.UUID, includeDeleted bool) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE user_id = ?
+	AND (? OR deleted_at IS NULL)
 	ORDER BY created_at DESC
 	`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.Query(query, userID, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	return scanVideos(rows)
+}
+
+// GetVideosIncludingDeleted returns every video, trashed ones too, since
+// their files are kept until they're purged
+func (c Client) GetVideosIncludingDeleted() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	ORDER BY created_at
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	return scanVideos(rows)
+}
+
+// GetStoredVideosWithStatus returns every video, across all users, that has
+// an uploaded file and one of the given processing statuses. Soft-deleted
+// videos are left out.
+func (c Client) GetStoredVideosWithStatus(statuses ...string) ([]Video, error) {
+	if len(statuses) == 0 {
+		return []Video{}, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(statuses)), ", ")
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE video_url IS NOT NULL
+	AND deleted_at IS NULL
+	AND processing_status IN (` + placeholders + `)
+	ORDER BY created_at
+	`
+
+	args := make([]any, len(statuses))
+	for i, status := range statuses {
+		args[i] = status
+	}
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	return scanVideos(rows)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+type GetVideosParams struct {
+	UserID         uuid.UUID
+	IncludeDeleted bool
+	// Search matches titles containing it, ignoring case
+	Search string
+	// Tag only matches videos with it, after normalization
+	Tag string
+	// Sort is one of the keys of videoSortOrders, defaulting to created_desc
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+var ErrInvalidSort = errors.New("invalid sort order")
+
+var videoSortOrders = map[string]string{
+	"created_asc":   "created_at ASC",
+	"created_desc":  "created_at DESC",
+	"title_asc":     "title COLLATE NOCASE ASC",
+	"duration_desc": "duration_seconds DESC",
+}
+
+// GetVideosPaginated returns one page of a user's videos along with the
+// total number of videos across all pages
+func (c Client) GetVideosPaginated(params GetVideosParams) ([]Video, int, error) {
+	if params.Sort == "" {
+		params.Sort = "created_desc"
+	}
+	orderBy, ok := videoSortOrders[params.Sort]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %q", ErrInvalidSort, params.Sort)
+	}
+
+	where := `
+	WHERE user_id = ?
+	AND (? OR deleted_at IS NULL)
+	`
+	args := []any{params.UserID, params.IncludeDeleted}
+
+	if tags := normalizeTags([]string{params.Tag}); len(tags) > 0 {
+		where += `AND EXISTS (SELECT 1 FROM video_tags WHERE video_id = videos.id AND tag = ?)
+	`
+		args = append(args, tags[0])
+	}
+
+	if params.Search != "" {
+		where += `AND title LIKE ? ESCAPE '\'
+	`
+		args = append(args, "%"+likeEscaper.Replace(params.Search)+"%")
+	}
+
+	var total int
+	err := c.db.QueryRow(`SELECT COUNT(*) FROM videos`+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos` + where + `
+	ORDER BY ` + orderBy + `, id
+	LIMIT ? OFFSET ?
+	`
+	rows, err := c.db.Query(query, append(args, params.Limit, params.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	videos, err := scanVideos(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return videos, total, nil
+}
+
+// VideoWithOwner is a video along with the email of the user who owns it
+type VideoWithOwner struct {
+	Video
+	OwnerEmail string
+}
+
+// GetAllVideosParams filters GetAllVideos. Zero values don't filter.
+type GetAllVideosParams struct {
+	UserID           uuid.UUID
+	ProcessingStatus string
+	Visibility       string
+	IncludeDeleted   bool
+	Limit            int
+	Offset           int
+}
+
+// GetAllVideos returns one page of every user's videos, newest first, along
+// with the total number of matching videos across all pages
+func (c Client) GetAllVideos(params GetAllVideosParams) ([]VideoWithOwner, int, error) {
+	where := `
+	WHERE (? OR deleted_at IS NULL)
+	`
+	args := []any{params.IncludeDeleted}
+	if params.UserID != uuid.Nil {
+		where += `AND user_id = ?
+	`
+		args = append(args, params.UserID)
+	}
+	if params.ProcessingStatus != "" {
+		where += `AND processing_status = ?
+	`
+		args = append(args, params.ProcessingStatus)
+	}
+	if params.Visibility != "" {
+		where += `AND visibility = ?
+	`
+		args = append(args, params.Visibility)
+	}
+
+	var total int
+	err := c.db.QueryRow(`SELECT COUNT(*) FROM videos`+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+	SELECT` + videoColumns + `,
+		COALESCE((SELECT email FROM users WHERE users.id = videos.user_id), '')
+	FROM videos` + where + `
+	ORDER BY created_at DESC, id
+	LIMIT ? OFFSET ?
+	`
+	rows, err := c.db.Query(query, append(args, params.Limit, params.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
 	defer rows.Close()
 
-	videos := []Video{}
+	videos := []VideoWithOwner{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
-			return nil, err
+		var video VideoWithOwner
+		video.Video, err = scanVideo(extraColumnsScanner{rows, []any{&video.OwnerEmail}})
+		if err != nil {
+			return nil, 0, err
 		}
 		videos = append(videos, video)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return videos, total, nil
+}
 
-	return videos, nil
+// extraColumnsScanner scans columns selected after videoColumns into extra
+type extraColumnsScanner struct {
+	rowScanner
+	extra []any
+}
+
+func (s extraColumnsScanner) Scan(dest ...any) error {
+	return s.rowScanner.Scan(append(dest, s.extra...)...)
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	id := uuid.New()
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Video{}, err
+	}
+	defer tx.Rollback()
+
 	query := `
 	INSERT INTO videos (
 		id,
@@ -75,10 +437,26 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		visibility,
+		region
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	visibility := params.Visibility
+	if visibility == "" {
+		visibility = VisibilityPrivate
+	}
+	_, err = tx.Exec(query, id, params.Title, params.Description, params.UserID, visibility, params.Region)
+	if err != nil {
+		return Video{}, err
+	}
+
+	err = setVideoTags(tx, id, params.Tags)
+	if err != nil {
+		return Video{}, err
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		return Video{}, err
 	}
@@ -88,29 +466,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -122,34 +483,286 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 }
 
 func (c Client) UpdateVideo(video Video) error {
+	return updateVideo(c.db, video)
+}
+
+func updateVideo(db execer, video Video) error {
 	query := `
 	UPDATE videos
 	SET
+		updated_at = CURRENT_TIMESTAMP,
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		user_id = ?,
+		size_bytes = ?,
+		duration_seconds = ?,
+		codec = ?,
+		hls_url = ?,
+		resolutions = ?,
+		upload_key = ?,
+		visibility = ?,
+		original_filename = ?,
+		sprite_url = ?,
+		sprite_index_url = ?,
+		faststart = ?,
+		archived = ?,
+		checksum_sha256 = ?,
+		original_url = ?,
+		original_size_bytes = ?,
+		original_checksum_sha256 = ?
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
+	_, err := db.Exec(
 		query,
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
 		&video.VideoURL,
 		video.UserID,
+		video.SizeBytes,
+		video.DurationSeconds,
+		video.Codec,
+		video.HLSURL,
+		video.Resolutions,
+		video.UploadKey,
+		video.Visibility,
+		video.OriginalFilename,
+		video.SpriteURL,
+		video.SpriteIndexURL,
+		video.FastStart,
+		video.Archived,
+		video.ChecksumSHA256,
+		video.OriginalURL,
+		video.OriginalSizeBytes,
+		video.OriginalChecksumSHA256,
 		video.ID,
 	)
 	return err
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
+// SetVideoProcessingStatus is kept separate from UpdateVideo so a metadata
+// edit made while a video is processing can't roll its status back.
+// processingError should be empty unless status is VideoStatusFailed.
+func (c Client) SetVideoProcessingStatus(id uuid.UUID, status, processingError string) error {
+	return setVideoProcessingStatus(c.db, id, status, processingError)
+}
+
+func setVideoProcessingStatus(db execer, id uuid.UUID, status, processingError string) error {
+	query := `
+	UPDATE videos
+	SET processing_status = ?, processing_error = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := db.Exec(query, status, processingError, id)
+	return err
+}
+
+// SetVideoCaption adds or replaces one caption track without touching the
+// others. language must already be validated, since it's part of a JSON path.
+func (c Client) SetVideoCaption(id uuid.UUID, language, url string) error {
+	query := `
+	UPDATE videos
+	SET captions = json_set(captions, ?, ?), updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, fmt.Sprintf(`$."%s"`, language), url, id)
+	return err
+}
+
+// IncrementVideoViews atomically bumps a video's view count and returns the
+// new count. UpdateVideo never writes view_count, so it can't clobber this.
+func (c Client) IncrementVideoViews(id uuid.UUID) (int64, error) {
+	query := `
+	UPDATE videos
+	SET view_count = view_count + 1
+	WHERE id = ? AND deleted_at IS NULL
+	RETURNING view_count
+	`
+
+	var viewCount int64
+	err := c.db.QueryRow(query, id).Scan(&viewCount)
+	if err != nil {
+		return 0, err
+	}
+	return viewCount, nil
+}
+
+// GetUserStorageBytes returns the bytes the user's videos take up, counting
+// retained originals as well as the processed files
+func (c Client) GetUserStorageBytes(userID uuid.UUID) (int64, error) {
+	query := `
+	SELECT COALESCE(SUM(size_bytes + original_size_bytes), 0)
+	FROM videos
+	WHERE user_id = ?
+	`
+
+	var total int64
+	err := c.db.QueryRow(query, userID).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// CountVideosByVideoURL counts the videos, including soft-deleted ones,
+// that point at videoURL
+func (c Client) CountVideosByVideoURL(videoURL string) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM videos
+	WHERE video_url = ?
+	`
+
+	var count int
+	err := c.db.QueryRow(query, videoURL).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// DeleteVideo permanently removes a video and returns the IDs of the
+// resumable uploads deleted with it, so their temp files can be removed
+func (c Client) DeleteVideo(id uuid.UUID) ([]uuid.UUID, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM video_tags WHERE video_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM share_links WHERE video_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query("DELETE FROM resumable_uploads WHERE video_id = ? RETURNING id", id)
+	if err != nil {
+		return nil, err
+	}
+	uploadIDs, err := scanUploadIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
+	_, err = tx.Exec(query, id)
+	if err != nil {
+		return nil, err
+	}
+	return uploadIDs, tx.Commit()
+}
+
+func (c Client) SoftDeleteVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET deleted_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+func (c Client) RestoreVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET deleted_at = NULL
+	WHERE id = ?
+	`
 	_, err := c.db.Exec(query, id)
 	return err
 }
+
+// PurgeExpiredVideos permanently removes videos that were soft deleted more
+// than retention ago and returns the removed rows, and the IDs of resumable
+// uploads deleted with them, so their files can be cleaned up
+func (c Client) PurgeExpiredVideos(retention time.Duration) ([]Video, []uuid.UUID, error) {
+	cutoff := fmt.Sprintf("-%d seconds", int64(retention.Seconds()))
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE deleted_at IS NOT NULL
+	AND deleted_at < datetime('now', ?)
+	`
+	rows, err := tx.Query(query, cutoff)
+	if err != nil {
+		return nil, nil, err
+	}
+	videos, err := scanVideos(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uploadIDs := []uuid.UUID{}
+	for _, video := range videos {
+		_, err = tx.Exec("DELETE FROM video_tags WHERE video_id = ?", video.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = tx.Exec("DELETE FROM share_links WHERE video_id = ?", video.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		rows, err := tx.Query("DELETE FROM resumable_uploads WHERE video_id = ? RETURNING id", video.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids, err := scanUploadIDs(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		uploadIDs = append(uploadIDs, ids...)
+		_, err = tx.Exec("DELETE FROM videos WHERE id = ?", video.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return videos, uploadIDs, nil
+}
+
+type UserVideoStats struct {
+	TotalVideos       int64 `json:"total_videos"`
+	TotalStorageBytes int64 `json:"total_storage_bytes"`
+	TotalViews        int64 `json:"total_views"`
+}
+
+// GetUserVideoStats totals a user's videos in one pass. Storage matches
+// GetUserStorageBytes: it counts retained originals, and soft-deleted videos
+// since their files are kept until they're purged.
+func (c Client) GetUserVideoStats(userID uuid.UUID) (UserVideoStats, error) {
+	query := `
+	SELECT
+		COUNT(*) FILTER (WHERE deleted_at IS NULL),
+		COALESCE(SUM(size_bytes + original_size_bytes), 0),
+		COALESCE(SUM(view_count) FILTER (WHERE deleted_at IS NULL), 0)
+	FROM videos
+	WHERE user_id = ?
+	`
+
+	var stats UserVideoStats
+	err := c.db.QueryRow(query, userID).Scan(&stats.TotalVideos, &stats.TotalStorageBytes, &stats.TotalViews)
+	if err != nil {
+		return UserVideoStats{}, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUserVideoStatsMatchStorageBytes(t *testing.T) {
+	c, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	user, err := c.CreateUser(CreateUserParams{Email: "user@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	sizes := []struct {
+		processed, original int64
+		deleted             bool
+	}{
+		{1000, 0, false},
+		{2000, 5000, false},
+		{3000, 7000, true},
+	}
+	for _, size := range sizes {
+		video, err := c.CreateVideo(CreateVideoParams{Title: "Video", UserID: user.ID})
+		if err != nil {
+			t.Fatalf("CreateVideo: %v", err)
+		}
+		video.SizeBytes = size.processed
+		video.OriginalSizeBytes = size.original
+		err = c.UpdateVideo(video)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+		if size.deleted {
+			err = c.SoftDeleteVideo(video.ID)
+			if err != nil {
+				t.Fatalf("SoftDeleteVideo: %v", err)
+			}
+		}
+	}
+
+	storageBytes, err := c.GetUserStorageBytes(user.ID)
+	if err != nil {
+		t.Fatalf("GetUserStorageBytes: %v", err)
+	}
+	stats, err := c.GetUserVideoStats(user.ID)
+	if err != nil {
+		t.Fatalf("GetUserVideoStats: %v", err)
+	}
+	if storageBytes != 18000 || stats.TotalStorageBytes != storageBytes {
+		t.Errorf("GetUserStorageBytes = %d, stats report %d, want both 18000", storageBytes, stats.TotalStorageBytes)
+	}
+}
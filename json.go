@@ -6,18 +6,78 @@ import (
 	"net/http"
 )
 
-func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
-	if err != nil {
-		log.Println(err)
+// Error codes are stable identifiers clients can branch on, unlike messages,
+// which are for people and may change. Most errors get the generic code for
+// their status; the more specific ones below are passed explicitly.
+const (
+	errCodeBadRequest         = "bad_request"
+	errCodeInvalidID          = "invalid_id"
+	errCodeInvalidFormat      = "invalid_format"
+	errCodeUnsupportedCodec   = "unsupported_codec"
+	errCodeTooLarge           = "too_large"
+	errCodeTooLong            = "too_long"
+	errCodeQuotaExceeded      = "quota_exceeded"
+	errCodeUnauthorized       = "unauthorized"
+	errCodeInvalidCredentials = "invalid_credentials"
+	errCodeInvalidToken       = "invalid_token"
+	errCodeForbidden          = "forbidden"
+	errCodeEmailNotVerified   = "email_not_verified"
+	errCodeNotFound           = "not_found"
+	errCodeConflict           = "conflict"
+	errCodeStillProcessing    = "still_processing"
+	errCodeRateLimited        = "rate_limited"
+	errCodeUnavailable        = "unavailable"
+	errCodeUpstream           = "upstream_error"
+	errCodeTimeout            = "timeout"
+	errCodeInternal           = "internal"
+)
+
+// errorCodeForStatus is the generic code for an HTTP status
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return errCodeUnauthorized
+	case http.StatusForbidden:
+		return errCodeForbidden
+	case http.StatusNotFound:
+		return errCodeNotFound
+	case http.StatusConflict:
+		return errCodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return errCodeTooLarge
+	case http.StatusTooManyRequests:
+		return errCodeRateLimited
+	case http.StatusBadGateway:
+		return errCodeUpstream
+	case http.StatusServiceUnavailable:
+		return errCodeUnavailable
+	case http.StatusGatewayTimeout:
+		return errCodeTimeout
 	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+	if status >= 500 {
+		return errCodeInternal
 	}
+	return errCodeBadRequest
+}
+
+// respondWithError sends msg to the client and records err for the request
+// log. err may be nil when the failure has no underlying cause, such as a
+// permission check.
+func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
+	respondWithErrorCode(w, code, errorCodeForStatus(code), msg, err)
+}
+
+// respondWithErrorCode is respondWithError with a more specific error code
+// than the status implies
+func respondWithErrorCode(w http.ResponseWriter, code int, errCode string, msg string, err error) {
+	logError(w, msg, err)
 	type errorResponse struct {
 		Error string `json:"error"`
+		Code  string `json:"code"`
 	}
 	respondWithJSON(w, code, errorResponse{
 		Error: msg,
+		Code:  errCode,
 	})
 }
 
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type requestIDKey struct{}
+
+// logLevel is the least severe level the default logger writes. It starts at
+// info and is changed by LOG_LEVEL once the environment is loaded.
+var logLevel = new(slog.LevelVar)
+
+// requestLog collects what handlers learn about a request so the logging
+// middleware can report it in a single line
+type requestLog struct {
+	userID   uuid.UUID
+	errorMsg string
+	err      error
+}
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	log    *requestLog
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requestIDHandler adds the request ID to records logged with a request's
+// context
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// findLoggingWriter looks through any writers wrapping the logging
+// middleware's own
+func findLoggingWriter(w http.ResponseWriter) (*loggingResponseWriter, bool) {
+	for {
+		switch v := w.(type) {
+		case *loggingResponseWriter:
+			return v, true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// logUserID records the authenticated user for the request's log line
+func logUserID(w http.ResponseWriter, userID uuid.UUID) {
+	if lw, ok := findLoggingWriter(w); ok {
+		lw.log.userID = userID
+	}
+}
+
+// logError records the message and underlying error of a failed response
+// for the request's log line
+func logError(w http.ResponseWriter, msg string, err error) {
+	if lw, ok := findLoggingWriter(w); ok {
+		lw.log.errorMsg = msg
+		lw.log.err = err
+	}
+}
+
+// accessLog writes a line per request to its own file, apart from the
+// application log. It only appends, so the file can be rotated from outside
+// with copytruncate.
+type accessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+	// format is combined, the Apache combined log format, or json
+	format string
+}
+
+func (l *accessLog) write(r *http.Request, start time.Time, status int, bytes int64, userID uuid.UUID) {
+	host := clientIP(r)
+
+	var line []byte
+	var err error
+	if l.format == "json" {
+		entry := struct {
+			Time       time.Time `json:"time"`
+			RemoteAddr string    `json:"remote_addr"`
+			UserID     string    `json:"user_id,omitempty"`
+			Method     string    `json:"method"`
+			URI        string    `json:"uri"`
+			Proto      string    `json:"proto"`
+			Status     int       `json:"status"`
+			Bytes      int64     `json:"bytes"`
+			DurationMS int64     `json:"duration_ms"`
+			Referer    string    `json:"referer,omitempty"`
+			UserAgent  string    `json:"user_agent,omitempty"`
+			RequestID  string    `json:"request_id,omitempty"`
+		}{
+			Time:       start.UTC(),
+			RemoteAddr: host,
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Status:     status,
+			Bytes:      bytes,
+			DurationMS: time.Since(start).Milliseconds(),
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+		}
+		if userID != uuid.Nil {
+			entry.UserID = userID.String()
+		}
+		entry.RequestID, _ = r.Context().Value(requestIDKey{}).(string)
+		line, err = json.Marshal(entry)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Couldn't encode access log entry", "error", err)
+			return
+		}
+		line = append(line, '\n')
+	} else {
+		user := "-"
+		if userID != uuid.Nil {
+			user = userID.String()
+		}
+		line = fmt.Appendf(nil, "%s - %s [%s] %q %d %d %q %q\n",
+			host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto, status, bytes,
+			orDash(r.Referer()), orDash(r.UserAgent()))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(line)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't write access log", "error", err)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// loggingMiddleware logs every request, and also writes it to access when
+// that isn't nil
+func loggingMiddleware(next http.Handler, access *accessLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := uuid.NewString()
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		lw := &loggingResponseWriter{ResponseWriter: w, log: &requestLog{}}
+		next.ServeHTTP(lw, r)
+
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if lw.log.userID != uuid.Nil {
+			attrs = append(attrs, slog.String("user_id", lw.log.userID.String()))
+		}
+		// the mux fills in path values on r as it routes
+		if videoID := r.PathValue("videoID"); videoID != "" {
+			attrs = append(attrs, slog.String("video_id", videoID))
+		}
+		if lw.log.errorMsg != "" {
+			attrs = append(attrs, slog.String("error_message", lw.log.errorMsg))
+		}
+		if lw.log.err != nil {
+			attrs = append(attrs, slog.String("error", lw.log.err.Error()))
+		}
+
+		level := slog.LevelInfo
+		if status > 499 {
+			level = slog.LevelError
+		} else if status > 399 {
+			level = slog.LevelWarn
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+
+		if access != nil {
+			access.write(r, start, status, lw.bytes, lw.log.userID)
+		}
+	})
+}
@@ -6,29 +6,106 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
-
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"golang.org/x/sync/semaphore"
 )
 
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string
-	s3Bucket         string
-	s3Region         string
-	s3CfDistribution string
-	port             string
-	s3Client         *s3.Client
+	db             database.Client
+	jwtSecret      string
+	platform       string
+	filepathRoot   string
+	assetsRoot     string
+	tempDir        string
+	s3Endpoint     string
+	s3UsePathStyle bool
+	s3SSE          types.ServerSideEncryption
+	kmsKeyID       *string
+	storageClass   types.StorageClass
+	archiveClass   types.StorageClass
+	// keyPrefix is prepended to every object key, so environments can
+	// share a bucket
+	keyPrefix string
+	port      string
+	// s3Stores holds a bucket per region, including the default one
+	s3Stores         map[string]*s3Store
+	defaultStore     *s3Store
+	s3PartSize       int64
+	s3Concurrency    int
+	s3UploadRetries  int
+	s3Timeout        time.Duration
+	ffmpegRetries    int
+	maxUploadBytes   int64
+	maxThumbnailSize int64
+	userQuotaBytes   int64
+	cfSigner         *sign.URLSigner
+	signedURLExpiry  time.Duration
+	urlCache         *signedURLCache
+	jwtExpiry        time.Duration
+	// refreshedExpiry is the lifetime of access tokens handed out for a
+	// refresh token, kept short since the client can always refresh again
+	refreshedExpiry  time.Duration
+	jwtIssuer        string
+	jwtAudience      string
+	shareLinkExpiry  time.Duration
+	idempotencyTTL   time.Duration
+	idempotencyLocks *keyedMutex
+	reprocessLocks   *keyedMutex
+	uploadLocks      *keyedMutex
+	// objectLocks serializes work on a deduplicated video file; see
+	// lockVideoObject
+	objectLocks   *keyedMutex
+	uploadLimiter *rateLimiter[uuid.UUID]
+	// thumbsLimiter limits the public thumbnail listing per client IP
+	thumbsLimiter  *rateLimiter[string]
+	processTimeout time.Duration
+	// maxDuration caps how long an uploaded video can be, unlimited when 0
+	maxDuration time.Duration
+	ffmpegSem   *semaphore.Weighted
+	hlsEnabled  bool
+	// keepOriginals stores every upload untouched next to the processed
+	// copy, roughly doubling storage
+	keepOriginals    bool
+	codecs           codecAllowlist
+	strictCodecs     bool
+	transcodeHeights []int
+	aspectPrefixes   map[string]string
+	thumbnailOptions thumbnailOptions
+	processingQueue  chan processingJob
+	metrics          *metrics
+	// webhookURL is notified when processing finishes, disabled when empty
+	webhookURL     string
+	webhookSecret  string
+	webhookRetries int
+	webhookPending *sync.WaitGroup
+	// publicURL is where the server is reachable, used for links in email
+	publicURL        string
+	emailSender      emailSender
+	emailTokenExpiry time.Duration
+	resetTokenExpiry time.Duration
+	moderation       ModerationProvider
 }
 
 type thumbnail struct {
@@ -36,10 +113,19 @@ type thumbnail struct {
 	mediaType string
 }
 
-func getVideoAspectRatio(videoPath string) (string, error) {
-	videoData, err := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", videoPath).Output()
+// aspectRatioTolerance is how far, relative to the target, a ratio may be off
+// and still count, since encoders round dimensions to multiples of 8 or 16
+const aspectRatioTolerance = 0.05
+
+// getVideoAspectRatio returns the width to height ratio of the first video
+// stream and the bucket it falls in: landscape, portrait, square or other
+func getVideoAspectRatio(ctx context.Context, videoPath string) (float64, string, error) {
+	videoData, err := execCommand(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0", "-print_format", "json", "-show_streams", videoPath).Output()
 	if err != nil {
-		return "", err
+		if ctx.Err() != nil {
+			return 0, "", ctx.Err()
+		}
+		return 0, "", err
 	}
 
 	var videoJSON struct {
@@ -51,34 +137,218 @@ func getVideoAspectRatio(videoPath string) (string, error) {
 
 	err = json.Unmarshal(videoData, &videoJSON)
 	if err != nil {
-		return "", err
+		return 0, "", err
 	}
 
 	if len(videoJSON.Streams) == 0 {
-		return "", errors.New("no streams found in video")
+		return 0, "", errors.New("no video stream found in video")
+	}
+	width, height := videoJSON.Streams[0].Width, videoJSON.Streams[0].Height
+	if width <= 0 || height <= 0 {
+		return 0, "", fmt.Errorf("invalid video dimensions %dx%d", width, height)
+	}
+
+	ratio := float64(width) / float64(height)
+	return ratio, classifyAspectRatio(ratio), nil
+}
+
+// classifyAspectRatio buckets ratios from 4:3 to 21:9 as landscape, their
+// inverses as portrait and those close to 1:1 as square
+func classifyAspectRatio(ratio float64) string {
+	const (
+		narrowest = 4.0 / 3
+		widest    = 21.0 / 9
+	)
+	switch {
+	case math.Abs(ratio-1) <= aspectRatioTolerance:
+		return "square"
+	case ratio >= narrowest*(1-aspectRatioTolerance) && ratio <= widest*(1+aspectRatioTolerance):
+		return "landscape"
+	case ratio <= (1/narrowest)*(1+aspectRatioTolerance) && ratio >= (1/widest)*(1-aspectRatioTolerance):
+		return "portrait"
+	}
+	return "other"
+}
+
+// defaultAspectPrefixes names the folder each aspect ratio bucket's videos are
+// stored under
+var defaultAspectPrefixes = map[string]string{
+	"landscape": "landscape",
+	"portrait":  "portrait",
+	"square":    "square",
+	"other":     "other",
+}
+
+// reservedPrefixes are folders used for objects other than videos
+var reservedPrefixes = []string{"thumbnails", "sprites", "captions", "hls", "uploads", "originals"}
+
+// parseAspectPrefixes reads a comma separated list of ratio=folder pairs,
+// such as "landscape=horizontal,portrait=vertical". Buckets left out keep
+// their default folder.
+func parseAspectPrefixes(s string) (map[string]string, error) {
+	prefixes := maps.Clone(defaultAspectPrefixes)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		bucket, folder, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q isn't a ratio=folder pair", pair)
+		}
+		bucket, folder = strings.TrimSpace(bucket), strings.TrimSpace(folder)
+		if _, ok := defaultAspectPrefixes[bucket]; !ok {
+			return nil, fmt.Errorf("unknown aspect ratio %q, expected landscape, portrait, square or other", bucket)
+		}
+		// renditionKey finds the folder by splitting the key on slashes
+		if folder == "" || folder == "." || folder == ".." || strings.ContainsAny(folder, `/\`) {
+			return nil, fmt.Errorf("folder %q for %s must be a single path segment", folder, bucket)
+		}
+		if slices.Contains(reservedPrefixes, folder) {
+			return nil, fmt.Errorf("folder %q for %s is reserved", folder, bucket)
+		}
+		prefixes[bucket] = folder
+	}
+	return prefixes, nil
+}
+
+type videoMetadata struct {
+	SizeBytes       int64
+	DurationSeconds float64
+	Codec           string
+	Width           int
+	Height          int
+	HasAudio        bool
+	AudioCodec      string
+}
+
+func getVideoMetadata(ctx context.Context, videoPath string) (videoMetadata, error) {
+	videoData, err := execCommand(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", videoPath).Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return videoMetadata{}, ctx.Err()
+		}
+		return videoMetadata{}, err
+	}
+
+	var videoJSON struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Size     string `json:"size"`
+			Duration string `json:"duration"`
+		} `json:"format"`
 	}
 
-	videoRatio := videoJSON.Streams[0].Width / videoJSON.Streams[0].Height
-	fmt.Println(videoRatio)
+	err = json.Unmarshal(videoData, &videoJSON)
+	if err != nil {
+		return videoMetadata{}, err
+	}
 
-	if videoRatio == 16/9 {
-		return "16:9", nil
+	metadata := videoMetadata{}
+	metadata.SizeBytes, err = strconv.ParseInt(videoJSON.Format.Size, 10, 64)
+	if err != nil {
+		return videoMetadata{}, fmt.Errorf("invalid size %q: %w", videoJSON.Format.Size, err)
+	}
+	metadata.DurationSeconds, err = strconv.ParseFloat(videoJSON.Format.Duration, 64)
+	if err != nil {
+		return videoMetadata{}, fmt.Errorf("invalid duration %q: %w", videoJSON.Format.Duration, err)
 	}
 
-	if videoRatio == 9/16 {
-		return "9:16", nil
+	for _, stream := range videoJSON.Streams {
+		switch stream.CodecType {
+		case "video":
+			if metadata.Codec == "" {
+				metadata.Codec = stream.CodecName
+				metadata.Width = stream.Width
+				metadata.Height = stream.Height
+			}
+		case "audio":
+			if !metadata.HasAudio {
+				metadata.HasAudio = true
+				metadata.AudioCodec = stream.CodecName
+			}
+		}
 	}
+	if metadata.Codec == "" {
+		return videoMetadata{}, errors.New("no video stream found in video")
+	}
+
+	return metadata, nil
+}
 
-	return "other", nil
+// acquireFFmpeg blocks until one of the limited ffmpeg slots is free, or ctx
+// is done. The returned func releases the slot.
+func (cfg *apiConfig) acquireFFmpeg(ctx context.Context) (func(), error) {
+	err := cfg.ffmpegSem.Acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return func() { cfg.ffmpegSem.Release(1) }, nil
 }
 
-func processVideoForFastStart(filePath string) (string, error) {
+// processVideoForFastStart moves the moov atom to the front of the file.
+// Streams in allowed codecs are copied as they are, which is quick; anything
+// else, or a copy ffmpeg can't manage, is re-encoded to H.264/AAC. Transient
+// ffmpeg failures are retried up to retries times.
+func processVideoForFastStart(ctx context.Context, filePath string, allowed codecAllowlist, retries int) (string, error) {
 	outputPath := filePath + ".processing"
 
-	command := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputPath)
-	fmt.Println(command.String())
+	metadata, err := getVideoMetadata(ctx, filePath)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err == nil && allowed.allows(metadata) {
+		err = runFFmpeg(ctx, retries, outputPath, "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputPath)
+		if err == nil {
+			return outputPath, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		slog.WarnContext(ctx, "Stream copy failed, re-encoding instead", "path", filePath, "error", err)
+	}
+
+	err = runFFmpeg(ctx, retries, outputPath, "-i", filePath, "-c:v", "libx264", "-pix_fmt", "yuv420p", "-c:a", "aac", "-movflags", "faststart", "-f", "mp4", outputPath)
+	if err != nil {
+		return "", err
+	}
+
+	return outputPath, nil
+}
+
+func convertToMP4(ctx context.Context, inputPath string) (string, error) {
+	outputPath := inputPath + ".mp4"
+
+	command := execCommand(ctx, "ffmpeg", "-i", inputPath, "-c:v", "libx264", "-c:a", "aac", "-f", "mp4", outputPath)
+	slog.DebugContext(ctx, "Running ffmpeg", "command", command.String())
 	err := command.Run()
 	if err != nil {
+		os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+
+	return outputPath, nil
+}
+
+func transcodeToHeight(ctx context.Context, inputPath string, height int) (string, error) {
+	outputPath := fmt.Sprintf("%s.%dp.mp4", inputPath, height)
+
+	command := execCommand(ctx, "ffmpeg", "-i", inputPath, "-vf", fmt.Sprintf("scale=-2:%d", height), "-c:v", "libx264", "-c:a", "aac", "-movflags", "faststart", "-f", "mp4", outputPath)
+	slog.DebugContext(ctx, "Running ffmpeg", "command", command.String())
+	err := command.Run()
+	if err != nil {
+		os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		return "", err
 	}
 
@@ -86,8 +356,35 @@ func processVideoForFastStart(filePath string) (string, error) {
 }
 
 func main() {
+	// the log package writes through this too, so every line is JSON
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})}))
+
 	godotenv.Load(".env")
 
+	if logLevelString := os.Getenv("LOG_LEVEL"); logLevelString != "" {
+		err := logLevel.UnmarshalText([]byte(logLevelString))
+		if err != nil {
+			log.Fatal("LOG_LEVEL must be debug, info, warn or error")
+		}
+	}
+
+	var access *accessLog
+	if accessLogPath := os.Getenv("ACCESS_LOG_PATH"); accessLogPath != "" {
+		format := os.Getenv("ACCESS_LOG_FORMAT")
+		if format == "" {
+			format = "combined"
+		}
+		if format != "combined" && format != "json" {
+			log.Fatal("ACCESS_LOG_FORMAT must be combined or json")
+		}
+		file, err := os.OpenFile(accessLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatalf("Couldn't open access log: %v", err)
+		}
+		defer file.Close()
+		access = &accessLog{w: file, format: format}
+	}
+
 	pathToDB := os.Getenv("DB_PATH")
 	if pathToDB == "" {
 		log.Fatal("DB_URL must be set")
@@ -103,6 +400,31 @@ func main() {
 		log.Fatal("JWT_SECRET environment variable is not set")
 	}
 
+	jwtExpiry := 30 * 24 * time.Hour
+	if jwtExpiryString := os.Getenv("JWT_EXPIRY"); jwtExpiryString != "" {
+		jwtExpiry, err = time.ParseDuration(jwtExpiryString)
+		if err != nil || jwtExpiry <= 0 {
+			log.Fatal("JWT_EXPIRY must be a positive duration (e.g. 1h)")
+		}
+	}
+	refreshedExpiry := time.Hour
+	if refreshedExpiryString := os.Getenv("REFRESHED_JWT_EXPIRY"); refreshedExpiryString != "" {
+		refreshedExpiry, err = time.ParseDuration(refreshedExpiryString)
+		if err != nil || refreshedExpiry <= 0 {
+			log.Fatal("REFRESHED_JWT_EXPIRY must be a positive duration (e.g. 1h)")
+		}
+	}
+
+	jwtIssuer := os.Getenv("JWT_ISSUER")
+	if jwtIssuer == "" {
+		jwtIssuer = "tubely"
+	}
+
+	jwtAudience := os.Getenv("JWT_AUDIENCE")
+	if jwtAudience == "" {
+		jwtAudience = "tubely-api"
+	}
+
 	platform := os.Getenv("PLATFORM")
 	if platform == "" {
 		log.Fatal("PLATFORM environment variable is not set")
@@ -118,6 +440,11 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
+	tempDir := os.Getenv("TEMP_DIR")
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+
 	s3Bucket := os.Getenv("S3_BUCKET")
 	if s3Bucket == "" {
 		log.Fatal("S3_BUCKET environment variable is not set")
@@ -128,21 +455,498 @@ func main() {
 		log.Fatal("S3_REGION environment variable is not set")
 	}
 
+	// point these at MinIO or LocalStack to run without AWS
+	s3Endpoint := os.Getenv("S3_ENDPOINT")
+	s3UsePathStyle := os.Getenv("S3_USE_PATH_STYLE") == "true"
+
+	awsCredentials := awsCredentialOptions{
+		profile:     os.Getenv("AWS_PROFILE"),
+		roleARN:     os.Getenv("S3_ASSUME_ROLE_ARN"),
+		externalID:  os.Getenv("S3_ASSUME_ROLE_EXTERNAL_ID"),
+		sessionName: os.Getenv("S3_ASSUME_ROLE_SESSION_NAME"),
+	}
+	if awsCredentials.sessionName == "" {
+		awsCredentials.sessionName = "tubely"
+	}
+	if awsCredentials.externalID != "" && awsCredentials.roleARN == "" {
+		log.Fatal("S3_ASSUME_ROLE_EXTERNAL_ID requires S3_ASSUME_ROLE_ARN")
+	}
+
 	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
 	if s3CfDistribution == "" {
 		log.Fatal("S3_CF_DISTRO environment variable is not set")
 	}
 
+	regionalBuckets, err := parseRegionalBuckets(os.Getenv("S3_REGIONAL_BUCKETS"), regionalBucket{region: s3Region, bucket: s3Bucket, distribution: s3CfDistribution})
+	if err != nil {
+		log.Fatalf("Invalid S3_REGIONAL_BUCKETS: %v", err)
+	}
+
+	// empty keeps keys at the bucket root
+	keyPrefix := strings.Trim(os.Getenv("S3_KEY_PREFIX"), "/")
+	if keyPrefix != "" {
+		keyPrefix += "/"
+	}
+
+	// uploads are left to the bucket's default encryption unless one of
+	// these is set
+	var s3SSE types.ServerSideEncryption
+	var kmsKeyID *string
+	switch sseString := os.Getenv("S3_SSE"); sseString {
+	case "":
+	case string(types.ServerSideEncryptionAes256), string(types.ServerSideEncryptionAwsKms):
+		s3SSE = types.ServerSideEncryption(sseString)
+	default:
+		log.Fatal("S3_SSE must be AES256 or aws:kms")
+	}
+	if kmsKeyIDString := os.Getenv("S3_KMS_KEY_ID"); kmsKeyIDString != "" {
+		if s3SSE == types.ServerSideEncryptionAes256 {
+			log.Fatal("S3_KMS_KEY_ID can't be used with S3_SSE=AES256")
+		}
+		s3SSE = types.ServerSideEncryptionAwsKms
+		kmsKeyID = aws.String(kmsKeyIDString)
+	}
+
+	storageClass := types.StorageClassStandard
+	if storageClassString := os.Getenv("S3_STORAGE_CLASS"); storageClassString != "" {
+		storageClass, err = parseStorageClass(storageClassString)
+		if err != nil {
+			log.Fatalf("Invalid S3_STORAGE_CLASS: %v", err)
+		}
+	}
+	archiveClass := types.StorageClassGlacierIr
+	if archiveClassString := os.Getenv("S3_ARCHIVE_STORAGE_CLASS"); archiveClassString != "" {
+		archiveClass, err = parseStorageClass(archiveClassString)
+		if err != nil {
+			log.Fatalf("Invalid S3_ARCHIVE_STORAGE_CLASS: %v", err)
+		}
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.Fatal("PORT environment variable is not set")
 	}
 
-	config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	s3PartSize := int64(manager.DefaultUploadPartSize)
+	if partSizeString := os.Getenv("S3_UPLOAD_PART_SIZE"); partSizeString != "" {
+		s3PartSize, err = strconv.ParseInt(partSizeString, 10, 64)
+		if err != nil || s3PartSize < manager.MinUploadPartSize {
+			log.Fatalf("S3_UPLOAD_PART_SIZE must be an integer of at least %d bytes", manager.MinUploadPartSize)
+		}
+	}
+
+	s3Concurrency := manager.DefaultUploadConcurrency
+	if concurrencyString := os.Getenv("S3_UPLOAD_CONCURRENCY"); concurrencyString != "" {
+		s3Concurrency, err = strconv.Atoi(concurrencyString)
+		if err != nil || s3Concurrency < 1 {
+			log.Fatal("S3_UPLOAD_CONCURRENCY must be a positive integer")
+		}
+	}
+
+	s3UploadRetries := 3
+	if retriesString := os.Getenv("S3_UPLOAD_RETRIES"); retriesString != "" {
+		s3UploadRetries, err = strconv.Atoi(retriesString)
+		if err != nil || s3UploadRetries < 0 {
+			log.Fatal("S3_UPLOAD_RETRIES must be a non-negative integer")
+		}
+	}
+
+	s3Timeout := 10 * time.Minute
+	if timeoutString := os.Getenv("S3_OPERATION_TIMEOUT"); timeoutString != "" {
+		s3Timeout, err = time.ParseDuration(timeoutString)
+		if err != nil || s3Timeout <= 0 {
+			log.Fatal("S3_OPERATION_TIMEOUT must be a positive duration (e.g. 10m)")
+		}
+	}
+
+	ffmpegRetries := 2
+	if retriesString := os.Getenv("FFMPEG_RETRIES"); retriesString != "" {
+		ffmpegRetries, err = strconv.Atoi(retriesString)
+		if err != nil || ffmpegRetries < 0 || ffmpegRetries > maxFFmpegRetries {
+			log.Fatalf("FFMPEG_RETRIES must be an integer from 0 to %d", maxFFmpegRetries)
+		}
+	}
+
+	maxUploadBytes := int64(1 << 30)
+	if maxUploadString := os.Getenv("MAX_UPLOAD_BYTES"); maxUploadString != "" {
+		maxUploadBytes, err = strconv.ParseInt(maxUploadString, 10, 64)
+		if err != nil || maxUploadBytes < 1 {
+			log.Fatal("MAX_UPLOAD_BYTES must be a positive integer")
+		}
+	}
+
+	maxThumbnailSize := int64(10 << 20)
+	if maxThumbnailString := os.Getenv("MAX_THUMBNAIL_BYTES"); maxThumbnailString != "" {
+		maxThumbnailSize, err = strconv.ParseInt(maxThumbnailString, 10, 64)
+		if err != nil || maxThumbnailSize < 1 {
+			log.Fatal("MAX_THUMBNAIL_BYTES must be a positive integer")
+		}
+	}
+
+	userQuotaBytes := int64(2 << 30)
+	if quotaString := os.Getenv("USER_QUOTA_BYTES"); quotaString != "" {
+		userQuotaBytes, err = strconv.ParseInt(quotaString, 10, 64)
+		if err != nil || userQuotaBytes < 0 {
+			log.Fatal("USER_QUOTA_BYTES must be a non-negative integer (0 disables the quota)")
+		}
+	}
+
+	objectAccess := objectAccessPrivate
+	switch accessString := os.Getenv("S3_OBJECT_ACCESS"); accessString {
+	case "", objectAccessPrivate:
+	case objectAccessPublicRead, objectAccessBucketPolicy:
+		objectAccess = accessString
+	default:
+		log.Fatalf("S3_OBJECT_ACCESS must be %s, %s or %s", objectAccessPrivate, objectAccessPublicRead, objectAccessBucketPolicy)
+	}
+	var objectACL types.ObjectCannedACL
+	if objectAccess == objectAccessPublicRead {
+		objectACL = types.ObjectCannedACLPublicRead
+	}
+
+	var cfSigner *sign.URLSigner
+	cfKeyPairID := os.Getenv("CF_KEY_PAIR_ID")
+	cfPrivateKeyPath := os.Getenv("CF_PRIVATE_KEY_PATH")
+	if cfKeyPairID != "" || cfPrivateKeyPath != "" {
+		if cfKeyPairID == "" || cfPrivateKeyPath == "" {
+			log.Fatal("CF_KEY_PAIR_ID and CF_PRIVATE_KEY_PATH must be set together")
+		}
+		if objectAccess != objectAccessPrivate {
+			log.Fatalf("CloudFront signing can't be used with S3_OBJECT_ACCESS=%s, since objects are public", objectAccess)
+		}
+		privateKey, err := sign.LoadPEMPrivKeyFile(cfPrivateKeyPath)
+		if err != nil {
+			log.Fatalf("Couldn't load CloudFront private key: %v", err)
+		}
+		cfSigner = sign.NewURLSigner(cfKeyPairID, privateKey)
+	}
+
+	signedURLExpiry := 15 * time.Minute
+	if expiryString := os.Getenv("CF_SIGNED_URL_EXPIRY"); expiryString != "" {
+		signedURLExpiry, err = time.ParseDuration(expiryString)
+		if err != nil || signedURLExpiry <= 0 {
+			log.Fatal("CF_SIGNED_URL_EXPIRY must be a positive duration (e.g. 15m)")
+		}
+	}
+
+	// signing is only worth caching when there's a signer
+	var urlCache *signedURLCache
+	urlCacheSize := 10000
+	if sizeString := os.Getenv("CF_SIGNED_URL_CACHE_SIZE"); sizeString != "" {
+		urlCacheSize, err = strconv.Atoi(sizeString)
+		if err != nil || urlCacheSize < 0 {
+			log.Fatal("CF_SIGNED_URL_CACHE_SIZE must be a non-negative integer")
+		}
+	}
+	if cfSigner != nil && urlCacheSize > 0 {
+		urlCache = newSignedURLCache(urlCacheSize)
+	}
+
+	var uploadLimiter *rateLimiter[uuid.UUID]
+	if uploadRateString := os.Getenv("UPLOAD_RATE_LIMIT"); uploadRateString != "" {
+		uploadsPerMinute, err := strconv.Atoi(uploadRateString)
+		if err != nil || uploadsPerMinute < 0 {
+			log.Fatal("UPLOAD_RATE_LIMIT must be a non-negative integer (0 disables the limit)")
+		}
+		if uploadsPerMinute > 0 {
+			uploadLimiter = newRateLimiter[uuid.UUID](uploadsPerMinute)
+			go uploadLimiter.runCleanup(time.Minute, 10*time.Minute)
+		}
+	}
+
+	var thumbsLimiter *rateLimiter[string]
+	thumbnailsPerMinute := 60
+	if thumbnailRateString := os.Getenv("THUMBNAIL_LIST_RATE_LIMIT"); thumbnailRateString != "" {
+		thumbnailsPerMinute, err = strconv.Atoi(thumbnailRateString)
+		if err != nil || thumbnailsPerMinute < 0 {
+			log.Fatal("THUMBNAIL_LIST_RATE_LIMIT must be a non-negative integer (0 disables the limit)")
+		}
+	}
+	if thumbnailsPerMinute > 0 {
+		thumbsLimiter = newRateLimiter[string](thumbnailsPerMinute)
+		go thumbsLimiter.runCleanup(time.Minute, 10*time.Minute)
+	}
+
+	shareLinkExpiry := 7 * 24 * time.Hour
+	if shareLinkExpiryString := os.Getenv("SHARE_LINK_EXPIRY"); shareLinkExpiryString != "" {
+		shareLinkExpiry, err = time.ParseDuration(shareLinkExpiryString)
+		if err != nil || shareLinkExpiry <= 0 {
+			log.Fatal("SHARE_LINK_EXPIRY must be a positive duration (e.g. 168h)")
+		}
+	}
+
+	idempotencyTTL := 24 * time.Hour
+	if idempotencyTTLString := os.Getenv("IDEMPOTENCY_TTL"); idempotencyTTLString != "" {
+		idempotencyTTL, err = time.ParseDuration(idempotencyTTLString)
+		if err != nil || idempotencyTTL <= 0 {
+			log.Fatal("IDEMPOTENCY_TTL must be a positive duration (e.g. 24h)")
+		}
+	}
+
+	multipartUploadMaxAge := 24 * time.Hour
+	if multipartUploadMaxAgeString := os.Getenv("MULTIPART_UPLOAD_MAX_AGE"); multipartUploadMaxAgeString != "" {
+		multipartUploadMaxAge, err = time.ParseDuration(multipartUploadMaxAgeString)
+		if err != nil || multipartUploadMaxAge <= 0 {
+			log.Fatal("MULTIPART_UPLOAD_MAX_AGE must be a positive duration (e.g. 24h)")
+		}
+	}
+
+	orphanSweepInterval := 24 * time.Hour
+	if intervalString := os.Getenv("ORPHAN_SWEEP_INTERVAL"); intervalString != "" {
+		orphanSweepInterval, err = time.ParseDuration(intervalString)
+		if err != nil || orphanSweepInterval <= 0 {
+			log.Fatal("ORPHAN_SWEEP_INTERVAL must be a positive duration (e.g. 24h)")
+		}
+	}
+	orphanSweepGrace := 24 * time.Hour
+	if graceString := os.Getenv("ORPHAN_SWEEP_GRACE"); graceString != "" {
+		orphanSweepGrace, err = time.ParseDuration(graceString)
+		if err != nil || orphanSweepGrace <= 0 {
+			log.Fatal("ORPHAN_SWEEP_GRACE must be a positive duration (e.g. 24h)")
+		}
+	}
+	orphanSweepDryRun := os.Getenv("ORPHAN_SWEEP_DELETE") != "true"
+
+	resumableUploadMaxAge := 24 * time.Hour
+	if resumableUploadMaxAgeString := os.Getenv("RESUMABLE_UPLOAD_MAX_AGE"); resumableUploadMaxAgeString != "" {
+		resumableUploadMaxAge, err = time.ParseDuration(resumableUploadMaxAgeString)
+		if err != nil || resumableUploadMaxAge <= 0 {
+			log.Fatal("RESUMABLE_UPLOAD_MAX_AGE must be a positive duration (e.g. 24h)")
+		}
+	}
+
+	var maxDuration time.Duration
+	if maxDurationString := os.Getenv("MAX_VIDEO_DURATION"); maxDurationString != "" {
+		maxDuration, err = time.ParseDuration(maxDurationString)
+		if err != nil || maxDuration <= 0 {
+			log.Fatal("MAX_VIDEO_DURATION must be a positive duration (e.g. 60m)")
+		}
+	}
+
+	processTimeout := 5 * time.Minute
+	if processTimeoutString := os.Getenv("PROCESS_TIMEOUT"); processTimeoutString != "" {
+		processTimeout, err = time.ParseDuration(processTimeoutString)
+		if err != nil || processTimeout <= 0 {
+			log.Fatal("PROCESS_TIMEOUT must be a positive duration (e.g. 5m)")
+		}
+	}
+
+	shutdownGracePeriod := 30 * time.Second
+	if shutdownGracePeriodString := os.Getenv("SHUTDOWN_GRACE_PERIOD"); shutdownGracePeriodString != "" {
+		shutdownGracePeriod, err = time.ParseDuration(shutdownGracePeriodString)
+		if err != nil || shutdownGracePeriod <= 0 {
+			log.Fatal("SHUTDOWN_GRACE_PERIOD must be a positive duration (e.g. 30s)")
+		}
+	}
+
+	ffmpegConcurrency := runtime.NumCPU()
+	if ffmpegConcurrencyString := os.Getenv("FFMPEG_CONCURRENCY"); ffmpegConcurrencyString != "" {
+		ffmpegConcurrency, err = strconv.Atoi(ffmpegConcurrencyString)
+		if err != nil || ffmpegConcurrency < 1 {
+			log.Fatal("FFMPEG_CONCURRENCY must be a positive integer")
+		}
+	}
+
+	processingWorkers := 2
+	if processingWorkersString := os.Getenv("PROCESSING_WORKERS"); processingWorkersString != "" {
+		processingWorkers, err = strconv.Atoi(processingWorkersString)
+		if err != nil || processingWorkers < 1 {
+			log.Fatal("PROCESSING_WORKERS must be a positive integer")
+		}
+	}
+
+	processingQueueSize := 100
+	if processingQueueSizeString := os.Getenv("PROCESSING_QUEUE_SIZE"); processingQueueSizeString != "" {
+		processingQueueSize, err = strconv.Atoi(processingQueueSizeString)
+		if err != nil || processingQueueSize < 0 {
+			log.Fatal("PROCESSING_QUEUE_SIZE must be a non-negative integer")
+		}
+	}
+
+	hlsEnabled := os.Getenv("HLS_ENABLED") == "true"
+	keepOriginals := os.Getenv("KEEP_ORIGINALS") == "true"
+
+	codecs := codecAllowlist{video: []string{"h264"}, audio: []string{"aac"}}
+	if videoCodecsString := os.Getenv("ALLOWED_VIDEO_CODECS"); videoCodecsString != "" {
+		codecs.video = parseCodecList(videoCodecsString)
+	}
+	if audioCodecsString := os.Getenv("ALLOWED_AUDIO_CODECS"); audioCodecsString != "" {
+		codecs.audio = parseCodecList(audioCodecsString)
+	}
+	strictCodecs := os.Getenv("STRICT_CODECS") == "true"
+	// outside strict mode anything else is re-encoded to H.264/AAC, which
+	// has to be allowed for the result to stick
+	if !strictCodecs && (!slices.Contains(codecs.video, "h264") || !slices.Contains(codecs.audio, "aac")) {
+		log.Fatal("ALLOWED_VIDEO_CODECS and ALLOWED_AUDIO_CODECS must include h264 and aac unless STRICT_CODECS=true")
+	}
+
+	publicURL := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if publicURL == "" {
+		publicURL = "http://localhost:" + port
+	}
+
+	var mailer emailSender = logEmailSender{}
+	if smtpAddr := os.Getenv("SMTP_ADDR"); smtpAddr != "" {
+		emailFrom := os.Getenv("EMAIL_FROM")
+		if emailFrom == "" {
+			log.Fatal("EMAIL_FROM must be set when SMTP_ADDR is")
+		}
+		mailer = smtpEmailSender{
+			addr:     smtpAddr,
+			from:     emailFrom,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+		}
+	} else if platform != "dev" {
+		log.Println("SMTP_ADDR isn't set, emails will only be logged")
+	}
+
+	emailTokenExpiry := 24 * time.Hour
+	if emailTokenExpiryString := os.Getenv("EMAIL_TOKEN_EXPIRY"); emailTokenExpiryString != "" {
+		emailTokenExpiry, err = time.ParseDuration(emailTokenExpiryString)
+		if err != nil || emailTokenExpiry <= 0 {
+			log.Fatal("EMAIL_TOKEN_EXPIRY must be a positive duration (e.g. 24h)")
+		}
+	}
+
+	resetTokenExpiry := time.Hour
+	if resetTokenExpiryString := os.Getenv("PASSWORD_RESET_EXPIRY"); resetTokenExpiryString != "" {
+		resetTokenExpiry, err = time.ParseDuration(resetTokenExpiryString)
+		if err != nil || resetTokenExpiry <= 0 {
+			log.Fatal("PASSWORD_RESET_EXPIRY must be a positive duration (e.g. 1h)")
+		}
+	}
+
+	var moderation ModerationProvider = noopModeration{}
+	if moderationURL := os.Getenv("MODERATION_URL"); moderationURL != "" {
+		moderation = httpModeration{url: moderationURL}
+	}
+
+	webhookURL := os.Getenv("WEBHOOK_URL")
+	webhookSecret := os.Getenv("WEBHOOK_SECRET")
+	if webhookURL != "" && webhookSecret == "" {
+		log.Fatal("WEBHOOK_SECRET must be set when WEBHOOK_URL is")
+	}
+
+	webhookRetries := 3
+	if webhookRetriesString := os.Getenv("WEBHOOK_RETRIES"); webhookRetriesString != "" {
+		webhookRetries, err = strconv.Atoi(webhookRetriesString)
+		if err != nil || webhookRetries < 0 {
+			log.Fatal("WEBHOOK_RETRIES must be a non-negative integer")
+		}
+	}
+
+	// no origins are allowed by default outside dev
+	corsAllowedOrigins := os.Getenv("CORS_ALLOWED_ORIGINS")
+	if corsAllowedOrigins == "" && platform == "dev" {
+		corsAllowedOrigins = "*"
+	}
+	corsAllowedMethods := os.Getenv("CORS_ALLOWED_METHODS")
+	if corsAllowedMethods == "" {
+		corsAllowedMethods = "GET,POST,PUT,DELETE,OPTIONS"
+	}
+	corsAllowedHeaders := os.Getenv("CORS_ALLOWED_HEADERS")
+	if corsAllowedHeaders == "" {
+		corsAllowedHeaders = "Authorization,Content-Type,Idempotency-Key"
+	}
+	cors := corsConfig{
+		allowedOrigins:   splitList(corsAllowedOrigins),
+		allowedMethods:   splitList(corsAllowedMethods),
+		allowedHeaders:   splitList(corsAllowedHeaders),
+		allowCredentials: os.Getenv("CORS_ALLOW_CREDENTIALS") == "true",
+	}
+
+	var appMetrics *metrics
+	if os.Getenv("METRICS_ENABLED") == "true" {
+		appMetrics = newMetrics()
+	}
+
+	transcodeHeightsString, ok := os.LookupEnv("TRANSCODE_HEIGHTS")
+	if !ok {
+		transcodeHeightsString = "720,480"
+	}
+	transcodeHeights := []int{}
+	for _, heightString := range strings.Split(transcodeHeightsString, ",") {
+		heightString = strings.TrimSpace(heightString)
+		if heightString == "" {
+			continue
+		}
+		height, err := strconv.Atoi(heightString)
+		if err != nil || height < 1 {
+			log.Fatal("TRANSCODE_HEIGHTS must be a comma separated list of positive integers")
+		}
+		transcodeHeights = append(transcodeHeights, height)
+	}
+
+	aspectPrefixes, err := parseAspectPrefixes(os.Getenv("ASPECT_RATIO_PREFIXES"))
 	if err != nil {
-		log.Fatalf("Couldn't load config: %v", err)
+		log.Fatalf("Invalid ASPECT_RATIO_PREFIXES: %v", err)
+	}
+
+	thumbnailOptions := thumbnailOptions{width: 640, format: "jpeg"}
+	if thumbnailWidthString, ok := os.LookupEnv("THUMBNAIL_WIDTH"); ok {
+		thumbnailOptions.width, err = strconv.Atoi(thumbnailWidthString)
+		if err != nil {
+			log.Fatal("THUMBNAIL_WIDTH must be an integer")
+		}
+	}
+	if thumbnailHeightString := os.Getenv("THUMBNAIL_HEIGHT"); thumbnailHeightString != "" {
+		thumbnailOptions.height, err = strconv.Atoi(thumbnailHeightString)
+		if err != nil {
+			log.Fatal("THUMBNAIL_HEIGHT must be an integer")
+		}
+	}
+	if thumbnailFormat := os.Getenv("THUMBNAIL_FORMAT"); thumbnailFormat != "" {
+		thumbnailOptions.format = strings.ToLower(thumbnailFormat)
+	}
+	err = thumbnailOptions.validate()
+	if err != nil {
+		log.Fatalf("Invalid thumbnail settings: %v", err)
+	}
+
+	s3Stores := map[string]*s3Store{}
+	for _, bucket := range append([]regionalBucket{{region: s3Region, bucket: s3Bucket, distribution: s3CfDistribution}}, regionalBuckets...) {
+		awsConfig, err := loadAWSConfig(context.Background(), bucket.region, awsCredentials)
+		if err != nil {
+			log.Fatalf("Couldn't load AWS config for %s: %v", bucket.region, err)
+		}
+		// the presign client is built from this one, so presigned requests
+		// use the same endpoint
+		client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+			if s3Endpoint != "" {
+				o.BaseEndpoint = aws.String(s3Endpoint)
+			}
+			o.UsePathStyle = s3UsePathStyle
+		})
+		s3Stores[bucket.region] = &s3Store{
+			region:        bucket.region,
+			bucket:        bucket.bucket,
+			client:        client,
+			presignClient: s3.NewPresignClient(client),
+			distribution:  bucket.distribution,
+			acl:           objectACL,
+		}
+		checkCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = checkObjectAccess(checkCtx, s3Stores[bucket.region], objectAccess)
+		cancel()
+		if err != nil {
+			log.Fatalf("Invalid S3_OBJECT_ACCESS: %v", err)
+		}
+	}
+
+	// objects in a dropped region would otherwise be looked for in the
+	// default bucket
+	storedRegions, err := db.GetStorageRegions()
+	if err != nil {
+		log.Fatalf("Couldn't get stored regions: %v", err)
+	}
+	missingRegions := slices.DeleteFunc(storedRegions, func(region string) bool {
+		_, ok := s3Stores[region]
+		return ok
+	})
+	if len(missingRegions) > 0 {
+		log.Fatalf("Videos are stored in regions missing from S3_REGIONAL_BUCKETS: %s", strings.Join(missingRegions, ", "))
 	}
-	client := s3.NewFromConfig(config)
 
 	cfg := apiConfig{
 		db:               db,
@@ -150,17 +954,91 @@ func main() {
 		platform:         platform,
 		filepathRoot:     filepathRoot,
 		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
+		tempDir:          tempDir,
+		s3Endpoint:       s3Endpoint,
+		s3UsePathStyle:   s3UsePathStyle,
+		s3SSE:            s3SSE,
+		kmsKeyID:         kmsKeyID,
+		storageClass:     storageClass,
+		archiveClass:     archiveClass,
+		keyPrefix:        keyPrefix,
 		port:             port,
-		s3Client:         client,
+		s3Stores:         s3Stores,
+		defaultStore:     s3Stores[s3Region],
+		s3PartSize:       s3PartSize,
+		s3Concurrency:    s3Concurrency,
+		s3UploadRetries:  s3UploadRetries,
+		s3Timeout:        s3Timeout,
+		ffmpegRetries:    ffmpegRetries,
+		maxUploadBytes:   maxUploadBytes,
+		maxThumbnailSize: maxThumbnailSize,
+		userQuotaBytes:   userQuotaBytes,
+		cfSigner:         cfSigner,
+		signedURLExpiry:  signedURLExpiry,
+		urlCache:         urlCache,
+		jwtExpiry:        jwtExpiry,
+		refreshedExpiry:  refreshedExpiry,
+		jwtIssuer:        jwtIssuer,
+		jwtAudience:      jwtAudience,
+		shareLinkExpiry:  shareLinkExpiry,
+		idempotencyTTL:   idempotencyTTL,
+		idempotencyLocks: newKeyedMutex(),
+		reprocessLocks:   newKeyedMutex(),
+		uploadLocks:      newKeyedMutex(),
+		objectLocks:      newKeyedMutex(),
+		uploadLimiter:    uploadLimiter,
+		thumbsLimiter:    thumbsLimiter,
+		processTimeout:   processTimeout,
+		maxDuration:      maxDuration,
+		ffmpegSem:        semaphore.NewWeighted(int64(ffmpegConcurrency)),
+		hlsEnabled:       hlsEnabled,
+		keepOriginals:    keepOriginals,
+		codecs:           codecs,
+		strictCodecs:     strictCodecs,
+		transcodeHeights: transcodeHeights,
+		aspectPrefixes:   aspectPrefixes,
+		thumbnailOptions: thumbnailOptions,
+		processingQueue:  make(chan processingJob, processingQueueSize),
+		metrics:          appMetrics,
+		webhookURL:       webhookURL,
+		webhookSecret:    webhookSecret,
+		webhookRetries:   webhookRetries,
+		webhookPending:   &sync.WaitGroup{},
+		publicURL:        publicURL,
+		emailSender:      mailer,
+		emailTokenExpiry: emailTokenExpiry,
+		resetTokenExpiry: resetTokenExpiry,
+		moderation:       moderation,
 	}
 
 	err = cfg.ensureAssetsDir()
 	if err != nil {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
+	err = cfg.ensureTempDir()
+	if err != nil {
+		log.Fatalf("Couldn't use temp directory: %v", err)
+	}
+	// multipart forms spill large files to os.TempDir, so point it here too
+	os.Setenv("TMPDIR", cfg.tempDir)
+
+	processingCtx, cancelProcessing := context.WithCancel(context.Background())
+	defer cancelProcessing()
+	stopWorkers := make(chan struct{})
+	var workers sync.WaitGroup
+	for range processingWorkers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			cfg.runProcessingWorker(processingCtx, stopWorkers)
+		}()
+	}
+	go cfg.runVideoReaper(time.Hour)
+	go cfg.runRevokedJWTPruner(time.Hour)
+	go cfg.runIdempotencyKeyPruner(time.Hour)
+	go cfg.runMultipartUploadJanitor(time.Hour, multipartUploadMaxAge)
+	go cfg.runResumableUploadJanitor(time.Hour, resumableUploadMaxAge)
+	go cfg.runOrphanSweeper(orphanSweepInterval, orphanSweepGrace, orphanSweepDryRun)
 
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
@@ -169,26 +1047,104 @@ func main() {
 	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
 	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
 
+	mux.HandleFunc("GET /healthz", cfg.handlerHealthz)
+	mux.HandleFunc("GET /readyz", cfg.handlerReadyz)
+	if cfg.metrics != nil {
+		mux.Handle("GET /metrics", cfg.metrics.handler())
+	}
+
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	mux.HandleFunc("POST /api/logout", cfg.requireAuth(cfg.handlerLogout))
+	mux.HandleFunc("POST /api/reset-password/request", cfg.handlerPasswordResetRequest)
+	mux.HandleFunc("POST /api/reset-password/confirm", cfg.handlerPasswordResetConfirm)
 
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("POST /api/users/verify/send", cfg.requireAuth(cfg.handlerSendVerificationEmail))
+	mux.HandleFunc("GET /api/verify-email/{token}", cfg.handlerVerifyEmail)
+	mux.HandleFunc("GET /api/users/{userID}/thumbnails", cfg.handlerUserThumbnails)
+	mux.HandleFunc("GET /api/users/me/stats", cfg.requireAuth(cfg.handlerUserStats))
 
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("POST /api/videos", cfg.requireAuth(cfg.handlerVideoMetaCreate))
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail", cfg.requireAuth(cfg.handlerUploadThumbnail))
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.requireAuth(cfg.handlerUploadThumbnail))
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.requireAuth(cfg.idempotent(cfg.handlerUploadVideo)))
+	mux.HandleFunc("PUT /api/videos/{videoID}/video", cfg.requireAuth(cfg.idempotent(cfg.handlerUploadVideo)))
+	mux.HandleFunc("POST /api/videos/{videoID}/reprocess", cfg.requireAuth(cfg.handlerVideoReprocess))
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail-frame", cfg.requireAuth(cfg.handlerVideoThumbnailFrame))
+	mux.HandleFunc("POST /api/videos/{videoID}/captions", cfg.requireAuth(cfg.handlerUploadCaptions))
+	mux.HandleFunc("POST /api/videos/{videoID}/upload-url", cfg.requireAuth(cfg.handlerVideoUploadURL))
+	mux.HandleFunc("POST /api/videos/{videoID}/upload-complete", cfg.requireAuth(cfg.handlerVideoUploadComplete))
+	mux.HandleFunc("POST /api/videos/{videoID}/uploads", cfg.requireAuth(cfg.handlerResumableUploadCreate))
+	mux.HandleFunc("HEAD /api/uploads/{uploadID}", cfg.requireAuth(cfg.handlerResumableUploadHead))
+	mux.HandleFunc("PATCH /api/uploads/{uploadID}", cfg.requireAuth(cfg.handlerResumableUploadPatch))
+	mux.HandleFunc("GET /api/videos", cfg.requireAuth(cfg.handlerVideosRetrieve))
+	mux.HandleFunc("DELETE /api/videos", cfg.requireAuth(cfg.handlerVideosBulkDelete))
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("GET /api/videos/{videoID}/url", cfg.requireAuth(cfg.handlerVideoURLGet))
+	mux.HandleFunc("GET /api/videos/{videoID}/stream", cfg.handlerVideoStream)
+	mux.HandleFunc("GET /api/videos/{videoID}/original", cfg.requireAuth(cfg.handlerVideoOriginalGet))
+	mux.HandleFunc("GET /api/public/videos/{videoID}", cfg.handlerPublicVideoGet)
+	mux.HandleFunc("POST /api/videos/{videoID}/share", cfg.requireAuth(cfg.handlerShareLinkCreate))
+	mux.HandleFunc("GET /api/videos/{videoID}/share", cfg.requireAuth(cfg.handlerShareLinksList))
+	mux.HandleFunc("DELETE /api/videos/{videoID}/share/{token}", cfg.requireAuth(cfg.handlerShareLinkRevoke))
+	mux.HandleFunc("GET /api/share/{token}", cfg.handlerShareLinkResolve)
+	mux.HandleFunc("POST /api/videos/{videoID}/view", cfg.handlerVideoView)
+	mux.HandleFunc("PUT /api/videos/{videoID}", cfg.requireAuth(cfg.handlerVideoMetaUpdate))
+	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.requireAuth(cfg.handlerVideoMetaDelete))
+	mux.HandleFunc("POST /api/videos/{videoID}/restore", cfg.requireAuth(cfg.handlerVideoRestore))
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /admin/videos/verify", cfg.requireAdmin(cfg.handlerAdminVerifyVideos))
+	mux.HandleFunc("GET /api/admin/videos", cfg.requireAdmin(cfg.handlerAdminVideosList))
 
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: loggingMiddleware(corsMiddleware(cors, mux), access),
+	}
+
+	shutdownCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("Serving on: http://localhost:%s/app/\n", port)
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-shutdownCtx.Done()
+	stop()
+	log.Printf("Shutting down, waiting up to %s for uploads to finish", shutdownGracePeriod)
+
+	graceCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+
+	err = srv.Shutdown(graceCtx)
+	if err != nil {
+		log.Printf("Couldn't finish in-flight requests: %v", err)
+		// dropping the connections makes the remaining handlers fail their
+		// reads and clean up their temp files
+		srv.Close()
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	close(stopWorkers)
+	workersDone := make(chan struct{})
+	go func() {
+		workers.Wait()
+		cfg.webhookPending.Wait()
+		close(workersDone)
+	}()
+
+	select {
+	case <-workersDone:
+	case <-graceCtx.Done():
+		log.Println("Grace period expired, cancelling video processing")
+		// ffmpeg is killed and partial S3 uploads are aborted
+		cancelProcessing()
+		<-workersDone
+	}
+	log.Println("Shutdown complete")
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	"golang.org/x/sync/semaphore"
+)
+
+// probeOutput is what ffprobe prints for a video with one video stream and,
+// unless audioCodec is empty, one audio stream
+func probeOutput(videoCodec string, width, height int, audioCodec string, durationSeconds float64) string {
+	streams := fmt.Sprintf(`{"codec_type":"video","codec_name":%q,"width":%d,"height":%d}`, videoCodec, width, height)
+	if audioCodec != "" {
+		streams += fmt.Sprintf(`,{"codec_type":"audio","codec_name":%q}`, audioCodec)
+	}
+	return fmt.Sprintf(`{"streams":[%s],"format":{"size":"1024","duration":"%g"}}`, streams, durationSeconds)
+}
+
+var testAllowlist = codecAllowlist{video: []string{"h264"}, audio: []string{"aac"}}
+
+// stubFastStart stands in for ffprobe, reporting probe, and for ffmpeg,
+// failing the runs fail picks and writing output for the rest
+func stubFastStart(t *testing.T, probe string, fail func(args []string) bool) *invocations {
+	t.Helper()
+	var calls invocations
+	stubCommands(t, func(name string, args []string) fakeCommand {
+		if name == "ffprobe" {
+			return fakeCommand{stdout: probe}
+		}
+		calls.record(name, args)
+		if fail(args) {
+			return fakeCommand{stderr: "Could not write header for output file\n", exitCode: 1}
+		}
+		return fakeCommand{output: "processed", outputPath: args[len(args)-1]}
+	})
+	return &calls
+}
+
+func isStreamCopy(args []string) bool {
+	i := slices.Index(args, "-c")
+	return i >= 0 && i+1 < len(args) && args[i+1] == "copy"
+}
+
+func writeTestVideo(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload.mp4")
+	err := os.WriteFile(path, []byte("raw"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestConfig returns a config backed by a fresh database and a bucket
+// held in memory, with everything optional turned off
+func newTestConfig(t *testing.T) (*apiConfig, *memoryS3) {
+	t.Helper()
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("database.NewClient: %v", err)
+	}
+	bucket := newMemoryS3()
+	store, _ := newTestS3Store(t, bucket.handle)
+
+	cfg := newTestS3Config()
+	cfg.db = db
+	cfg.jwtSecret = "secret"
+	cfg.jwtIssuer = "tubely"
+	cfg.jwtAudience = "tubely-api"
+	cfg.tempDir = t.TempDir()
+	cfg.s3Stores = map[string]*s3Store{store.region: store}
+	cfg.defaultStore = store
+	cfg.maxUploadBytes = 1 << 20
+	cfg.processTimeout = time.Minute
+	cfg.ffmpegSem = semaphore.NewWeighted(1)
+	cfg.codecs = testAllowlist
+	cfg.aspectPrefixes = defaultAspectPrefixes
+	cfg.thumbnailOptions = thumbnailOptions{width: 640, format: "jpeg"}
+	cfg.processingQueue = make(chan processingJob, 1)
+	cfg.moderation = noopModeration{}
+	cfg.idempotencyLocks = newKeyedMutex()
+	cfg.reprocessLocks = newKeyedMutex()
+	cfg.uploadLocks = newKeyedMutex()
+	cfg.objectLocks = newKeyedMutex()
+	return cfg, bucket
+}
+
+// createTestVideo adds a video owned by a new, verified user and returns it
+// with an access token for the user
+func createTestVideo(t *testing.T, cfg *apiConfig) (database.Video, string) {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: uuid.NewString() + "@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	verificationToken := uuid.NewString()
+	err = cfg.db.CreateEmailVerificationToken(database.CreateEmailVerificationTokenParams{
+		Token:     verificationToken,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("CreateEmailVerificationToken: %v", err)
+	}
+	_, err = cfg.db.VerifyEmail(verificationToken)
+	if err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Test video", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	token, err := auth.MakeJWT(user.ID, auth.RoleUser, cfg.jwtSecret, cfg.jwtIssuer, cfg.jwtAudience, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+	return video, token
+}
+
+func TestProcessVideoForFastStartCopiesAllowedCodecs(t *testing.T) {
+	calls := stubFastStart(t, probeOutput("h264", 1920, 1080, "aac", 10), func([]string) bool { return false })
+
+	outputPath, err := processVideoForFastStart(context.Background(), writeTestVideo(t), testAllowlist, 0)
+	if err != nil {
+		t.Fatalf("processVideoForFastStart: %v", err)
+	}
+	if calls.count() != 1 || !isStreamCopy(calls.calls[0]) {
+		t.Errorf("ffmpeg ran %v, want a single stream copy", calls.calls)
+	}
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Errorf("output wasn't written: %v", err)
+	}
+}
+
+func TestProcessVideoForFastStartReencodesWhenCopyFails(t *testing.T) {
+	calls := stubFastStart(t, probeOutput("h264", 1920, 1080, "aac", 10), isStreamCopy)
+
+	_, err := processVideoForFastStart(context.Background(), writeTestVideo(t), testAllowlist, 0)
+	if err != nil {
+		t.Fatalf("processVideoForFastStart: %v", err)
+	}
+	if calls.count() != 2 || !isStreamCopy(calls.calls[0]) || !slices.Contains(calls.calls[1], "libx264") {
+		t.Errorf("ffmpeg ran %v, want a stream copy then a re-encode", calls.calls)
+	}
+}
+
+func TestProcessVideoForFastStartReencodesDisallowedCodecs(t *testing.T) {
+	calls := stubFastStart(t, probeOutput("hevc", 1920, 1080, "aac", 10), func([]string) bool { return false })
+
+	_, err := processVideoForFastStart(context.Background(), writeTestVideo(t), testAllowlist, 0)
+	if err != nil {
+		t.Fatalf("processVideoForFastStart: %v", err)
+	}
+	if calls.count() != 1 || !slices.Contains(calls.calls[0], "libx264") {
+		t.Errorf("ffmpeg ran %v, want a single re-encode", calls.calls)
+	}
+}
+
+func TestClassifyAspectRatio(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		want          string
+	}{
+		{"1080p", 1920, 1080, "landscape"},
+		{"1080p padded to 16", 1920, 1088, "landscape"},
+		{"720p", 1280, 720, "landscape"},
+		{"16:10", 1920, 1200, "landscape"},
+		{"4:3", 640, 480, "landscape"},
+		{"21:9", 2560, 1080, "landscape"},
+		{"vertical 1080p", 1080, 1920, "portrait"},
+		{"vertical 1080p padded to 16", 1088, 1920, "portrait"},
+		{"3:4", 480, 640, "portrait"},
+		{"9:21", 1080, 2520, "portrait"},
+		{"square", 1080, 1080, "square"},
+		{"nearly square", 1080, 1050, "square"},
+		{"5:4", 1280, 1024, "other"},
+		{"32:9", 3840, 1080, "other"},
+		{"9:32", 1080, 3840, "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ratio := float64(tt.width) / float64(tt.height)
+			if got := classifyAspectRatio(ratio); got != tt.want {
+				t.Errorf("classifyAspectRatio(%dx%d = %.3f) = %q, want %q", tt.width, tt.height, ratio, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyAspectRatioTolerance(t *testing.T) {
+	tests := []struct {
+		name  string
+		ratio float64
+		want  string
+	}{
+		{"square within the tolerance", 1 + aspectRatioTolerance - 0.001, "square"},
+		{"past square", 1 + aspectRatioTolerance + 0.01, "other"},
+		{"narrowest landscape within the tolerance", 4.0 / 3 * (1 - aspectRatioTolerance + 0.001), "landscape"},
+		{"past narrowest landscape", 4.0 / 3 * (1 - aspectRatioTolerance - 0.01), "other"},
+		{"widest landscape within the tolerance", 21.0 / 9 * (1 + aspectRatioTolerance - 0.001), "landscape"},
+		{"past widest landscape", 21.0 / 9 * (1 + aspectRatioTolerance + 0.01), "other"},
+		{"widest portrait within the tolerance", 3.0 / 4 * (1 + aspectRatioTolerance - 0.001), "portrait"},
+		{"past widest portrait", 3.0 / 4 * (1 + aspectRatioTolerance + 0.01), "other"},
+		{"narrowest portrait within the tolerance", 9.0 / 21 * (1 - aspectRatioTolerance + 0.001), "portrait"},
+		{"past narrowest portrait", 9.0 / 21 * (1 - aspectRatioTolerance - 0.01), "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyAspectRatio(tt.ratio); got != tt.want {
+				t.Errorf("classifyAspectRatio(%.4f) = %q, want %q", tt.ratio, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFFmpegStopsWhenContextIsCancelled(t *testing.T) {
+	path := writeTestVideo(t)
+
+	tests := []struct {
+		name string
+		// hang is the command left running when the context is cancelled
+		hang string
+		run  func(ctx context.Context) error
+	}{
+		{"faststart", "ffmpeg", func(ctx context.Context) error {
+			_, err := processVideoForFastStart(ctx, path, testAllowlist, 0)
+			return err
+		}},
+		{"aspect ratio", "ffprobe", func(ctx context.Context) error {
+			_, _, err := getVideoAspectRatio(ctx, path)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var hung invocations
+			cancelled := make(chan time.Time, 1)
+			stubCommands(t, func(name string, args []string) fakeCommand {
+				fake := fakeCommand{}
+				if name == "ffprobe" {
+					fake.stdout = probeOutput("h264", 1920, 1080, "aac", 10)
+				}
+				if name == tt.hang {
+					hung.record(name, args)
+					fake.sleep = time.Minute
+					// give the process time to start before cancelling
+					time.AfterFunc(100*time.Millisecond, func() {
+						cancelled <- time.Now()
+						cancel()
+					})
+				}
+				return fake
+			})
+
+			err := tt.run(ctx)
+			if hung.count() == 0 {
+				t.Fatalf("%s never ran, error = %v", tt.hang, err)
+			}
+			// the command is waited on, so returning means it was killed
+			if elapsed := time.Since(<-cancelled); elapsed > 5*time.Second {
+				t.Errorf("took %v to return after cancelling", elapsed)
+			}
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("error = %v, want %v", err, context.Canceled)
+			}
+		})
+	}
+}
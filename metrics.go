@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics is nil unless METRICS_ENABLED is set, and every method is a no-op
+// on a nil receiver so call sites don't have to check
+type metrics struct {
+	registry       *prometheus.Registry
+	uploadBytes    prometheus.Histogram
+	uploadDuration prometheus.Histogram
+	ffmpegDuration *prometheus.HistogramVec
+	s3PutDuration  prometheus.Histogram
+	s3PutRetries   prometheus.Counter
+	uploadFailures *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		uploadBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "tubely_upload_bytes",
+			Help:    "Size of uploaded videos.",
+			Buckets: prometheus.ExponentialBuckets(1<<20, 4, 8),
+		}),
+		uploadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "tubely_upload_duration_seconds",
+			Help:    "Time to receive and queue an uploaded video.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+		}),
+		ffmpegDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tubely_ffmpeg_duration_seconds",
+			Help:    "Time spent in each ffmpeg step.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+		}, []string{"step"}),
+		s3PutDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "tubely_s3_put_duration_seconds",
+			Help:    "Time to upload an object to S3.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+		}),
+		s3PutRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tubely_s3_put_retries_total",
+			Help: "S3 uploads retried after a transient error.",
+		}),
+		uploadFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tubely_upload_failures_total",
+			Help: "Uploads that failed, by reason.",
+		}, []string{"reason"}),
+	}
+	m.registry.MustRegister(
+		m.uploadBytes,
+		m.uploadDuration,
+		m.ffmpegDuration,
+		m.s3PutDuration,
+		m.s3PutRetries,
+		m.uploadFailures,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *metrics) observeUpload(bytes int64, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.uploadBytes.Observe(float64(bytes))
+	m.uploadDuration.Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) observeFFmpeg(step string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.ffmpegDuration.WithLabelValues(step).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) observeS3Put(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.s3PutDuration.Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) s3PutRetried() {
+	if m == nil {
+		return
+	}
+	m.s3PutRetries.Inc()
+}
+
+func (m *metrics) uploadFailed(reason string) {
+	if m == nil {
+		return
+	}
+	m.uploadFailures.WithLabelValues(reason).Inc()
+}
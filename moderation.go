@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+type moderationDecision string
+
+const (
+	moderationApprove moderationDecision = "approve"
+	moderationReject  moderationDecision = "reject"
+	// moderationFlag holds the video for a person to review
+	moderationFlag moderationDecision = "flag"
+)
+
+// ModerationProvider decides whether a processed video can be published,
+// judging by a frame from it
+type ModerationProvider interface {
+	Moderate(ctx context.Context, video database.Video, thumbnailPath string) (moderationDecision, error)
+}
+
+// noopModeration approves everything, leaving moderation off
+type noopModeration struct{}
+
+func (noopModeration) Moderate(ctx context.Context, video database.Video, thumbnailPath string) (moderationDecision, error) {
+	return moderationApprove, nil
+}
+
+var moderationClient = &http.Client{Timeout: 30 * time.Second}
+
+// httpModeration posts the thumbnail to an external service, which answers
+// with {"decision": "approve" | "reject" | "flag"}
+type httpModeration struct {
+	url string
+}
+
+func (m httpModeration) Moderate(ctx context.Context, video database.Video, thumbnailPath string) (moderationDecision, error) {
+	thumbnail, err := os.ReadFile(thumbnailPath)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(thumbnail))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(thumbnail))
+	req.Header.Set("X-Video-ID", video.ID.String())
+
+	resp, err := moderationClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("moderation service responded with %s", resp.Status)
+	}
+
+	var result struct {
+		Decision moderationDecision `json:"decision"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	switch result.Decision {
+	case moderationApprove, moderationReject, moderationFlag:
+		return result.Decision, nil
+	}
+	return "", fmt.Errorf("unknown moderation decision %q", result.Decision)
+}
+
+// moderationStatus is the processing status a video gets for decision
+func moderationStatus(decision moderationDecision) string {
+	switch decision {
+	case moderationReject:
+		return database.VideoStatusRejected
+	case moderationFlag:
+		return database.VideoStatusUnderReview
+	}
+	return database.VideoStatusReady
+}
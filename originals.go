@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// videoExtensions maps the upload types we accept to the extension their
+// originals are stored and downloaded with
+var videoExtensions = map[string]string{
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"video/webm":      ".webm",
+}
+
+// uploadOriginal stores the raw upload at rawPath untouched, returning its
+// size and hex SHA-256
+func (cfg *apiConfig) uploadOriginal(ctx context.Context, store *s3Store, key, rawPath, mediaType string, storageClass types.StorageClass) (int64, string, error) {
+	checksum, err := hashFile(rawPath)
+	if err != nil {
+		return 0, "", err
+	}
+
+	file, err := os.Open(rawPath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = cfg.uploadToS3WithChecksum(ctx, store, key, file, mediaType, storageClass, checksum)
+	if err != nil {
+		return 0, "", err
+	}
+	return stat.Size(), checksum, nil
+}
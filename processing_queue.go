@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var errProcessingQueueFull = errors.New("processing queue is full")
+
+// processingJob is a raw upload waiting to be processed. The worker owns
+// rawPath once the job is queued and removes it when done.
+type processingJob struct {
+	videoID   uuid.UUID
+	rawPath   string
+	mediaType string
+	// originalFilename is saved on the video once processing succeeds
+	originalFilename string
+	// uploadKey is the raw object left by a direct upload, deleted once
+	// processing succeeds
+	uploadKey string
+}
+
+// enqueueProcessing marks the video as processing and hands the job to a
+// worker without waiting for it to run
+func (cfg *apiConfig) enqueueProcessing(job processingJob) error {
+	err := cfg.db.SetVideoProcessingStatus(job.videoID, database.VideoStatusProcessing, "")
+	if err != nil {
+		return err
+	}
+
+	select {
+	case cfg.processingQueue <- job:
+		return nil
+	default:
+	}
+
+	err = cfg.db.SetVideoProcessingStatus(job.videoID, database.VideoStatusFailed, "Processing queue is full")
+	if err != nil {
+		slog.Error("Couldn't mark video as failed", "video_id", job.videoID, "error", err)
+	}
+	return errProcessingQueueFull
+}
+
+// runProcessingWorker runs queued jobs until stop is closed. Cancelling ctx
+// aborts the job in progress.
+func (cfg *apiConfig) runProcessingWorker(ctx context.Context, stop <-chan struct{}) {
+	for {
+		// check stop first so a busy queue can't keep the worker going
+		select {
+		case <-stop:
+			cfg.abandonQueuedJobs()
+			return
+		default:
+		}
+
+		select {
+		case <-stop:
+			cfg.abandonQueuedJobs()
+			return
+		case job := <-cfg.processingQueue:
+			cfg.runProcessingJob(ctx, job)
+		}
+	}
+}
+
+// abandonQueuedJobs fails any jobs that hadn't started when shutdown began,
+// so their temp files aren't left behind and their owners can retry
+func (cfg *apiConfig) abandonQueuedJobs() {
+	for {
+		select {
+		case job := <-cfg.processingQueue:
+			os.Remove(job.rawPath)
+			err := cfg.db.SetVideoProcessingStatus(job.videoID, database.VideoStatusFailed, "Server shut down before processing, please upload again")
+			if err != nil {
+				slog.Error("Couldn't mark video as failed", "video_id", job.videoID, "error", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (cfg *apiConfig) runProcessingJob(ctx context.Context, job processingJob) {
+	defer os.Remove(job.rawPath)
+
+	video, err := cfg.db.GetVideo(job.videoID)
+	if err == nil && video.ID == uuid.Nil {
+		err = errors.New("video no longer exists")
+	}
+	if err != nil {
+		slog.Error("Couldn't get video for processing", "video_id", job.videoID, "error", err)
+		return
+	}
+
+	video.OriginalFilename = job.originalFilename
+	processed, err := cfg.processVideoUpload(ctx, video, job.rawPath, job.mediaType)
+	if err != nil {
+		slog.Error("Couldn't process video", "video_id", job.videoID, "error", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			cfg.metrics.uploadFailed("processing_timeout")
+		} else {
+			cfg.metrics.uploadFailed("processing")
+		}
+
+		message := "Couldn't process video"
+		var procErr *processingError
+		if errors.As(err, &procErr) {
+			message = procErr.message
+		}
+		err = cfg.db.SetVideoProcessingStatus(job.videoID, database.VideoStatusFailed, message)
+		if err != nil {
+			slog.Error("Couldn't mark video as failed", "video_id", job.videoID, "error", err)
+		}
+		cfg.notifyProcessingDone(ctx, webhookPayload{
+			VideoID: job.videoID,
+			Status:  database.VideoStatusFailed,
+			Error:   message,
+		})
+		return
+	}
+
+	cfg.notifyProcessingDone(ctx, webhookPayload{
+		VideoID:         job.videoID,
+		Status:          processed.ProcessingStatus,
+		DurationSeconds: processed.DurationSeconds,
+	})
+
+	if job.uploadKey != "" {
+		err = cfg.deleteS3Object(context.Background(), cfg.videoStore(processed), job.uploadKey)
+		if err != nil {
+			// the processed copy is already saved, so this only leaks storage
+			slog.Error("Couldn't delete raw upload", "video_id", job.videoID, "key", job.uploadKey, "error", err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter is an in-memory token bucket limiter keyed by user or client
+type rateLimiter[K comparable] struct {
+	mu      sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64
+	buckets map[K]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+func newRateLimiter[K comparable](perMinute int) *rateLimiter[K] {
+	return &rateLimiter[K]{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: map[K]*tokenBucket{},
+	}
+}
+
+// allow takes a token for key, or reports how long until one is available
+func (rl *rateLimiter[K]) allow(key K) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, lastSeen: now}
+		rl.buckets[key] = bucket
+	}
+
+	bucket.tokens = min(rl.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*rl.rate)
+	bucket.lastSeen = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rl.rate * float64(time.Second))
+		return false, wait
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+// runCleanup periodically forgets keys that haven't been seen for idle, by
+// which point their bucket would have refilled anyway
+func (rl *rateLimiter[K]) runCleanup(interval, idle time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rl.mu.Lock()
+		for key, bucket := range rl.buckets {
+			if time.Since(bucket.lastSeen) > idle {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// clientIP is the address the request came from, without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+const softDeleteRetention = 30 * 24 * time.Hour
+
+// runVideoReaper permanently removes soft-deleted videos, and their S3
+// objects, once they've been in the trash longer than softDeleteRetention
+func (cfg *apiConfig) runVideoReaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cfg.purgeExpiredVideos()
+	}
+}
+
+func (cfg *apiConfig) purgeExpiredVideos() {
+	videos, uploadIDs, err := cfg.db.PurgeExpiredVideos(softDeleteRetention)
+	if err != nil {
+		log.Printf("Couldn't purge expired videos: %v", err)
+		return
+	}
+	cfg.removeResumableUploadFiles(uploadIDs)
+
+	err = cfg.deleteVideoObjects(context.Background(), videos)
+	if err != nil {
+		log.Printf("Couldn't delete objects for purged videos: %v", err)
+	}
+
+	if len(videos) > 0 {
+		log.Printf("Purged %d expired videos", len(videos))
+	}
+}
+
+// runRevokedJWTPruner drops revoked token IDs once the tokens have expired,
+// since ValidateJWT rejects expired tokens on its own
+func (cfg *apiConfig) runRevokedJWTPruner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pruned, err := cfg.db.PruneRevokedJWTs()
+		if err != nil {
+			log.Printf("Couldn't prune revoked JWTs: %v", err)
+			continue
+		}
+		if pruned > 0 {
+			log.Printf("Pruned %d revoked JWTs", pruned)
+		}
+	}
+}
+
+func (cfg *apiConfig) runIdempotencyKeyPruner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pruned, err := cfg.db.PruneIdempotencyKeys()
+		if err != nil {
+			log.Printf("Couldn't prune idempotency keys: %v", err)
+			continue
+		}
+		if pruned > 0 {
+			log.Printf("Pruned %d idempotency keys", pruned)
+		}
+	}
+}
+
+// runMultipartUploadJanitor aborts multipart uploads that were started more
+// than maxAge ago and never completed, such as ones cut off by a crash
+func (cfg *apiConfig) runMultipartUploadJanitor(interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, store := range cfg.s3Stores {
+			aborted, err := cfg.abortStaleMultipartUploads(context.Background(), store, maxAge)
+			if err != nil {
+				log.Printf("Couldn't abort stale multipart uploads in %s: %v", store.bucket, err)
+			}
+			if aborted > 0 {
+				log.Printf("Aborted %d stale multipart uploads in %s", aborted, store.bucket)
+			}
+		}
+	}
+}
+
+func (cfg *apiConfig) abortStaleMultipartUploads(ctx context.Context, store *s3Store, maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+	aborted := 0
+
+	// other environments may share the bucket under their own key prefix
+	paginator := s3.NewListMultipartUploadsPaginator(store.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(store.bucket),
+		Prefix: aws.String(cfg.keyPrefix),
+	})
+	for paginator.HasMorePages() {
+		pageCtx, cancel := cfg.s3Context(ctx)
+		page, err := paginator.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return aborted, err
+		}
+		for _, upload := range page.Uploads {
+			if upload.Initiated == nil || upload.Initiated.After(cutoff) {
+				continue
+			}
+			abortCtx, cancel := cfg.s3Context(ctx)
+			_, err := store.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(store.bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			cancel()
+			if err != nil {
+				log.Printf("Couldn't abort multipart upload %s of %s: %v", aws.ToString(upload.UploadId), aws.ToString(upload.Key), err)
+				continue
+			}
+			aborted++
+		}
+	}
+	return aborted, nil
+}
+
+// runResumableUploadJanitor deletes uploads that stopped receiving chunks
+// more than maxAge ago, along with their temp files
+func (cfg *apiConfig) runResumableUploadJanitor(interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ids, err := cfg.db.DeleteStaleResumableUploads(maxAge)
+		if err != nil {
+			log.Printf("Couldn't delete stale resumable uploads: %v", err)
+			continue
+		}
+		cfg.removeResumableUploadFiles(ids)
+		if len(ids) > 0 {
+			log.Printf("Deleted %d stale resumable uploads", len(ids))
+		}
+	}
+}
+
+// removeResumableUploadFiles deletes the bytes received for uploads whose
+// rows are gone
+func (cfg *apiConfig) removeResumableUploadFiles(ids []uuid.UUID) {
+	for _, id := range ids {
+		// wait out a chunk that's still being written
+		unlock := cfg.uploadLocks.lock(id.String())
+		os.Remove(cfg.resumableUploadPath(id))
+		unlock()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// renditionKey files a rendition under its height, between any key prefix
+// and the <aspect ratio>/<hash> that video keys end with
+func renditionKey(videoKey string, height int) string {
+	hash := path.Base(videoKey)
+	aspectRatio := path.Base(path.Dir(videoKey))
+	prefix, ok := strings.CutSuffix(videoKey, aspectRatio+"/"+hash)
+	if !ok {
+		return fmt.Sprintf("%dp/%s", height, videoKey)
+	}
+	return fmt.Sprintf("%s%dp/%s/%s", prefix, height, aspectRatio, hash)
+}
+
+// videoURLForQuality returns the URL of the rendition closest to the
+// requested height, or the original when quality is empty or only the
+// original is available
+func (cfg *apiConfig) videoURLForQuality(video database.Video, quality string) (*string, error) {
+	if quality == "" || video.VideoURL == nil || len(video.Resolutions) < 2 {
+		return video.VideoURL, nil
+	}
+
+	requested, err := strconv.Atoi(quality)
+	if err != nil || requested < 1 {
+		return nil, fmt.Errorf("invalid quality %q", quality)
+	}
+
+	original := video.Resolutions[0]
+	closest := original
+	for _, height := range video.Resolutions {
+		distance := abs(height - requested)
+		closestDistance := abs(closest - requested)
+		if distance < closestDistance || (distance == closestDistance && height > closest) {
+			closest = height
+		}
+	}
+	if closest == original {
+		return video.VideoURL, nil
+	}
+
+	videoKey, ok := cfg.objectKeyFromURL(video.VideoURL)
+	if !ok {
+		return video.VideoURL, nil
+	}
+	url := cfg.videoStore(video).distribution + renditionKey(videoKey, closest)
+	return &url, nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -9,11 +9,12 @@ func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := cfg.db.Reset()
+	uploadIDs, err := cfg.db.Reset()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't reset database", err)
 		return
 	}
+	cfg.removeResumableUploadFiles(uploadIDs)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Database reset to initial state"))
 }
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// s3Store is a bucket, the client for its region and the CloudFront
+// distribution serving it
+type s3Store struct {
+	region        string
+	bucket        string
+	client        *s3.Client
+	presignClient *s3.PresignClient
+	distribution  string
+	// acl is the canned ACL new objects get, empty to leave the bucket's
+	// default in place
+	acl types.ObjectCannedACL
+}
+
+// storeForRegion returns the bucket for a region, falling back to the
+// default bucket for an empty region. Startup fails if anything is stored in
+// a region without a bucket.
+func (cfg *apiConfig) storeForRegion(region string) *s3Store {
+	if store, ok := cfg.s3Stores[region]; ok {
+		return store
+	}
+	return cfg.defaultStore
+}
+
+// videoStore returns the bucket every object of a video is stored in, picked
+// from its owner's region when the video was created
+func (cfg *apiConfig) videoStore(video database.Video) *s3Store {
+	return cfg.storeForRegion(video.Region)
+}
+
+// regionalBucket is one entry of S3_REGIONAL_BUCKETS
+type regionalBucket struct {
+	region       string
+	bucket       string
+	distribution string
+}
+
+// parseRegionalBuckets reads a comma separated list of
+// region:bucket:distribution entries, such as
+// "eu-west-1:tubely-eu:https://d111.cloudfront.net/". Stored URLs are matched
+// to their bucket by distribution, so no two buckets, including the default
+// one, can share a region or have overlapping distributions.
+func parseRegionalBuckets(s string, defaultBucket regionalBucket) ([]regionalBucket, error) {
+	buckets := []regionalBucket{}
+	seen := []regionalBucket{defaultBucket}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("%q isn't a region:bucket:distribution entry", entry)
+		}
+		bucket := regionalBucket{region: parts[0], bucket: parts[1], distribution: parts[2]}
+		for _, other := range seen {
+			if bucket.region == other.region {
+				return nil, fmt.Errorf("region %s has more than one bucket", bucket.region)
+			}
+			if strings.HasPrefix(bucket.distribution, other.distribution) || strings.HasPrefix(other.distribution, bucket.distribution) {
+				return nil, fmt.Errorf("distribution %s for %s overlaps with %s for %s", bucket.distribution, bucket.region, other.distribution, other.region)
+			}
+		}
+		seen = append(seen, bucket)
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// s3Context bounds one S3 operation by the configured timeout, so a hung
+// connection can't hold a request, worker or ffmpeg slot forever
+func (cfg *apiConfig) s3Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cfg.s3Timeout)
+}
+
+// s3ErrorStatus is the status to respond with when an S3 operation fails:
+// 504 if it timed out, otherwise 500
+func s3ErrorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// uploadToS3Multipart retries the whole upload on transient failures, after
+// the SDK's own per-request retries have given up. body is rewound before
+// each attempt. Objects belonging to a video are stored in its class, from
+// videoStorageClass, so archiving doesn't miss any.
+func (cfg *apiConfig) uploadToS3Multipart(ctx context.Context, store *s3Store, key string, body io.ReadSeeker, contentType string, storageClass types.StorageClass) error {
+	return cfg.uploadToS3WithChecksum(ctx, store, key, body, contentType, storageClass, "")
+}
+
+// uploadToS3WithChecksum is uploadToS3Multipart for a body whose hex SHA-256
+// is known, so S3 rejects it if the bytes are corrupted on the way. S3 only
+// takes a whole-object SHA-256 for single part uploads; larger bodies are
+// checked part by part instead.
+func (cfg *apiConfig) uploadToS3WithChecksum(ctx context.Context, store *s3Store, key string, body io.ReadSeeker, contentType string, storageClass types.StorageClass, sha256Hex string) error {
+	input := s3.PutObjectInput{
+		Bucket:               aws.String(store.bucket),
+		Key:                  aws.String(key),
+		ContentType:          aws.String(contentType),
+		ServerSideEncryption: cfg.s3SSE,
+		SSEKMSKeyId:          cfg.kmsKeyID,
+		StorageClass:         storageClass,
+		ACL:                  store.acl,
+	}
+	if sha256Hex != "" {
+		sum, err := hex.DecodeString(sha256Hex)
+		if err != nil {
+			return fmt.Errorf("invalid checksum %q: %w", sha256Hex, err)
+		}
+		size, err := body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if size < cfg.s3PartSize {
+			input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(sum))
+		} else {
+			input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+		}
+	}
+
+	uploader := manager.NewUploader(store.client, func(u *manager.Uploader) {
+		u.PartSize = cfg.s3PartSize
+		u.Concurrency = cfg.s3Concurrency
+		// the uploader aborts with the upload's own context, which does
+		// nothing once it's cancelled, so abortFailedUpload does it instead
+		u.LeavePartsOnError = true
+	})
+
+	slog.DebugContext(ctx, "Uploading to S3", "bucket", store.bucket, "key", key, "content_type", contentType)
+	// the timeout covers every attempt, and a part upload it cuts off is
+	// still aborted since abortFailedUpload doesn't inherit it
+	ctx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	start := time.Now()
+	defer cfg.metrics.observeS3Put(start)
+
+	for attempt := 0; ; attempt++ {
+		_, err := body.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		// each attempt gets its own copy, since the uploader fills in fields
+		attemptInput := input
+		attemptInput.Body = body
+		_, err = uploader.Upload(ctx, &attemptInput)
+		if err != nil {
+			cfg.abortFailedUpload(ctx, store, key, err)
+		}
+		if err == nil || attempt >= cfg.s3UploadRetries || !isRetryableS3Error(err) {
+			return err
+		}
+
+		delay := retryDelay(attempt)
+		slog.WarnContext(ctx, "Retrying S3 upload", "key", key, "attempt", attempt+1, "delay", delay, "error", err)
+		cfg.metrics.s3PutRetried()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// abortFailedUpload discards the parts of a failed multipart upload so they
+// aren't billed. It runs even if ctx was cancelled; anything it misses is
+// left for runMultipartUploadJanitor.
+func (cfg *apiConfig) abortFailedUpload(ctx context.Context, store *s3Store, key string, uploadErr error) {
+	var multipartErr manager.MultiUploadFailure
+	if !errors.As(uploadErr, &multipartErr) || multipartErr.UploadID() == "" {
+		return
+	}
+
+	abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	_, err := store.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(store.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(multipartErr.UploadID()),
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "Couldn't abort failed multipart upload", "key", key, "upload_id", multipartErr.UploadID(), "error", err)
+	}
+}
+
+// isRetryableS3Error uses the SDK's classification, so throttling, 5xx and
+// connection errors are retried while auth and other 4xx errors are not
+func isRetryableS3Error(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// retryDelay is exponential backoff with full jitter, capped so a long
+// outage doesn't stall a job for minutes between attempts
+func retryDelay(attempt int) time.Duration {
+	const (
+		base     = 500 * time.Millisecond
+		maxDelay = 20 * time.Second
+	)
+	// base<<6 is already past maxDelay, and larger shifts overflow
+	backoff := min(base<<min(attempt, 6), maxDelay)
+	return time.Duration(rand.Int64N(int64(backoff))) + time.Millisecond
+}
+
+func (cfg *apiConfig) deleteS3Object(ctx context.Context, store *s3Store, key string) error {
+	slog.DebugContext(ctx, "Deleting from S3", "bucket", store.bucket, "key", key)
+	cfg.urlCache.invalidate(store.distribution + key)
+	ctx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	_, err := store.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NoSuchKey" || apiErr.ErrorCode() == "NotFound") {
+		return nil
+	}
+	return err
+}
+
+// maxDeleteObjectsKeys is the most keys S3 accepts in one DeleteObjects call
+const maxDeleteObjectsKeys = 1000
+
+// deleteS3Objects removes keys with as few DeleteObjects calls as possible.
+// Keys that don't exist count as deleted. The error joins the failures of
+// every key that couldn't be deleted.
+func (cfg *apiConfig) deleteS3Objects(ctx context.Context, store *s3Store, keys []string) error {
+	var errs []error
+	for batch := range slices.Chunk(keys, maxDeleteObjectsKeys) {
+		slog.DebugContext(ctx, "Deleting from S3", "bucket", store.bucket, "keys", batch)
+		objects := make([]types.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			cfg.urlCache.invalidate(store.distribution + key)
+			objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+		batchCtx, cancel := cfg.s3Context(ctx)
+		output, err := store.client.DeleteObjects(batchCtx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(store.bucket),
+			Delete: &types.Delete{
+				Objects: objects,
+				// only report the failures
+				Quiet: aws.Bool(true),
+			},
+		})
+		cancel()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, objectErr := range output.Errors {
+			errs = append(errs, fmt.Errorf("%s: %s", aws.ToString(objectErr.Key), aws.ToString(objectErr.Message)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteVideoObjects removes the S3 objects of videos whose rows are already
+// gone, HLS directories included. A file another video still shares through
+// deduplication is kept.
+func (cfg *apiConfig) deleteVideoObjects(ctx context.Context, videos []database.Video) error {
+	keysByStore := map[*s3Store][]string{}
+	var errs []error
+	for _, video := range videos {
+		store := cfg.videoStore(video)
+		// the HLS directory belongs to this video alone, so all of it goes
+		hlsKeys, err := cfg.hlsObjectKeys(ctx, video)
+		if err != nil {
+			return fmt.Errorf("couldn't list HLS objects for video %s: %w", video.ID, err)
+		}
+		keysByStore[store] = append(keysByStore[store], hlsKeys...)
+		keysByStore[store] = append(keysByStore[store], cfg.perVideoObjectKeys(video)...)
+		errs = append(errs, cfg.deleteSharedObjects(ctx, store, video))
+	}
+
+	for store, keys := range keysByStore {
+		errs = append(errs, cfg.deleteS3Objects(ctx, store, keys))
+	}
+	return errors.Join(errs...)
+}
+
+// deleteSharedObjects deletes the video file and renditions of a deleted
+// video unless another video still uses them. It deletes them right away
+// rather than with the rest of the batch so the check stays valid.
+func (cfg *apiConfig) deleteSharedObjects(ctx context.Context, store *s3Store, video database.Video) error {
+	keys := cfg.sharedObjectKeys(video)
+	if len(keys) == 0 {
+		return nil
+	}
+	unlock := cfg.lockVideoObject(store, keys[0])
+	defer unlock()
+	references, err := cfg.db.CountVideosByVideoURL(*video.VideoURL)
+	if err != nil {
+		return fmt.Errorf("couldn't check references for video %s: %w", video.ID, err)
+	}
+	if references > 0 {
+		return nil
+	}
+	return cfg.deleteS3Objects(ctx, store, keys)
+}
+
+// downloadS3Object writes the object at key to file, fetching parts in
+// parallel
+func (cfg *apiConfig) downloadS3Object(ctx context.Context, store *s3Store, key string, file *os.File) error {
+	slog.DebugContext(ctx, "Downloading from S3", "bucket", store.bucket, "key", key)
+	ctx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	downloader := manager.NewDownloader(store.client, func(d *manager.Downloader) {
+		d.PartSize = cfg.s3PartSize
+		d.Concurrency = cfg.s3Concurrency
+	})
+	_, err := downloader.Download(ctx, file, &s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (cfg *apiConfig) s3ObjectExists(ctx context.Context, store *s3Store, key string) (bool, error) {
+	ctx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	_, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// s3ObjectStorageClass returns the class the object at key is stored in
+func (cfg *apiConfig) s3ObjectStorageClass(ctx context.Context, store *s3Store, key string) (types.StorageClass, error) {
+	ctx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	head, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	// S3 leaves the header out for STANDARD
+	if head.StorageClass == "" {
+		return types.StorageClassStandard, nil
+	}
+	return head.StorageClass, nil
+}
+
+// listS3Keys returns the key of every object under prefix
+func (cfg *apiConfig) listS3Keys(ctx context.Context, store *s3Store, prefix string) ([]string, error) {
+	keys := []string{}
+	paginator := s3.NewListObjectsV2Paginator(store.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(store.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		pageCtx, cancel := cfg.s3Context(ctx)
+		page, err := paginator.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys, nil
+}
+
+// hlsObjectKeys lists the playlists and segments in a video's HLS
+// directory, which the master playlist sits at the top of
+func (cfg *apiConfig) hlsObjectKeys(ctx context.Context, video database.Video) ([]string, error) {
+	playlistKey, ok := cfg.objectKeyFromURL(video.HLSURL)
+	if !ok {
+		return nil, nil
+	}
+	return cfg.listS3Keys(ctx, cfg.videoStore(video), path.Dir(playlistKey)+"/")
+}
+
+// copyS3Object copies an object within the bucket without downloading it
+func (cfg *apiConfig) copyS3Object(ctx context.Context, store *s3Store, sourceKey, destinationKey string, storageClass types.StorageClass) error {
+	slog.DebugContext(ctx, "Copying within S3", "bucket", store.bucket, "source_key", sourceKey, "destination_key", destinationKey, "storage_class", storageClass)
+	ctx, cancel := cfg.s3Context(ctx)
+	defer cancel()
+	segments := strings.Split(store.bucket+"/"+sourceKey, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	_, err := store.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:               aws.String(store.bucket),
+		Key:                  aws.String(destinationKey),
+		CopySource:           aws.String(strings.Join(segments, "/")),
+		ServerSideEncryption: cfg.s3SSE,
+		SSEKMSKeyId:          cfg.kmsKeyID,
+		StorageClass:         storageClass,
+		// copies don't keep the source's ACL
+		ACL: store.acl,
+	})
+	return err
+}
+
+// parseStorageClass accepts any storage class S3 knows about. Objects in
+// GLACIER or DEEP_ARCHIVE have to be restored before they can be fetched, so
+// signed URLs for them fail until then; GLACIER_IR serves reads directly.
+func parseStorageClass(s string) (types.StorageClass, error) {
+	storageClass := types.StorageClass(strings.ToUpper(s))
+	if !slices.Contains(storageClass.Values(), storageClass) {
+		return "", fmt.Errorf("unknown storage class %q", s)
+	}
+	return storageClass, nil
+}
+
+// videoStorageClass is the class a video's objects should be stored in
+func (cfg *apiConfig) videoStorageClass(video database.Video) types.StorageClass {
+	if video.Archived {
+		return cfg.archiveClass
+	}
+	return cfg.storageClass
+}
+
+// applyVideoStorageClass copies a video's objects in place into the storage
+// class it should be in, for when it's archived or unarchived. A file shared
+// with other videos through deduplication is left alone, since they may not
+// be archived. Objects already in the class are skipped, since S3 rejects an
+// in-place copy that changes nothing.
+func (cfg *apiConfig) applyVideoStorageClass(ctx context.Context, video database.Video) error {
+	keys := cfg.videoObjectKeys(video)
+	if video.VideoURL != nil {
+		references, err := cfg.db.CountVideosByVideoURL(*video.VideoURL)
+		if err != nil {
+			return err
+		}
+		if references > 1 {
+			keys = cfg.perVideoObjectKeys(video)
+		}
+	}
+	hlsKeys, err := cfg.hlsObjectKeys(ctx, video)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, hlsKeys...)
+
+	store := cfg.videoStore(video)
+	storageClass := cfg.videoStorageClass(video)
+	for _, key := range keys {
+		current, err := cfg.s3ObjectStorageClass(ctx, store, key)
+		if err != nil {
+			return err
+		}
+		if current == storageClass {
+			continue
+		}
+		err = cfg.copyS3Object(ctx, store, key, key, storageClass)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectKeyFromURL returns the S3 key for a URL served through one of our
+// distributions, or false if the URL points somewhere else. Each bucket has
+// its own distribution, so the URL also says which bucket the key is in.
+func (cfg *apiConfig) objectKeyFromURL(url *string) (string, bool) {
+	if url == nil {
+		return "", false
+	}
+	for _, store := range cfg.s3Stores {
+		key, ok := strings.CutPrefix(*url, store.distribution)
+		if ok && key != "" {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// videoObjectKeys returns the keys of every S3 object stored for a video
+func (cfg *apiConfig) videoObjectKeys(video database.Video) []string {
+	return append(cfg.perVideoObjectKeys(video), cfg.sharedObjectKeys(video)...)
+}
+
+// sharedObjectKeys returns the keys of the video file and its renditions,
+// which deduplicated uploads share between videos. Only delete them while
+// holding lockVideoObject for the video file and after checking nothing
+// references it.
+func (cfg *apiConfig) sharedObjectKeys(video database.Video) []string {
+	videoKey, ok := cfg.objectKeyFromURL(video.VideoURL)
+	if !ok {
+		return nil
+	}
+	keys := []string{videoKey}
+	if len(video.Resolutions) > 1 {
+		for _, height := range video.Resolutions[1:] {
+			keys = append(keys, renditionKey(videoKey, height))
+		}
+	}
+	return keys
+}
+
+// lockVideoObject locks the deduplicated video file at key. Processing holds
+// it from finding or uploading the file until the video pointing at it is
+// saved, and deletions hold it while checking for references, so a file is
+// never deleted just as another video starts using it.
+func (cfg *apiConfig) lockVideoObject(store *s3Store, key string) func() {
+	return cfg.objectLocks.lock(store.bucket + "/" + key)
+}
+
+// perVideoObjectKeys returns the keys of objects that belong to this video
+// alone. The video file and its renditions may be shared with other videos
+// through deduplication, so they aren't included.
+func (cfg *apiConfig) perVideoObjectKeys(video database.Video) []string {
+	keys := []string{}
+	if key, ok := cfg.objectKeyFromURL(video.ThumbnailURL); ok {
+		keys = append(keys, key)
+	}
+	for _, url := range []*string{video.SpriteURL, video.SpriteIndexURL, video.OriginalURL} {
+		if key, ok := cfg.objectKeyFromURL(url); ok {
+			keys = append(keys, key)
+		}
+	}
+	for _, url := range video.Captions {
+		if key, ok := cfg.objectKeyFromURL(&url); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// How stored objects are served. Private objects are only reachable through
+// the distribution, with signed URLs if CloudFront signing is configured.
+// The public modes hand out plain URLs, with objects readable either because
+// each one is uploaded public-read or because a bucket policy allows it.
+const (
+	objectAccessPrivate      = "private"
+	objectAccessPublicRead   = "public-read"
+	objectAccessBucketPolicy = "bucket-policy"
+)
+
+// checkObjectAccess fails if the bucket's settings would stop objects being
+// read publicly in the given mode. Settings it isn't allowed to read are
+// logged and skipped, since the bucket can still be set up correctly.
+func checkObjectAccess(ctx context.Context, store *s3Store, access string) error {
+	if access == objectAccessPrivate {
+		return nil
+	}
+
+	var apiErr smithy.APIError
+	block, err := store.client.GetPublicAccessBlock(ctx, &s3.GetPublicAccessBlockInput{
+		Bucket: aws.String(store.bucket),
+	})
+	switch {
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchPublicAccessBlockConfiguration":
+	case err != nil:
+		log.Printf("Couldn't check public access block for %s: %v", store.bucket, err)
+	default:
+		settings := block.PublicAccessBlockConfiguration
+		if access == objectAccessPublicRead && (aws.ToBool(settings.BlockPublicAcls) || aws.ToBool(settings.IgnorePublicAcls)) {
+			return fmt.Errorf("bucket %s blocks public ACLs", store.bucket)
+		}
+		if access == objectAccessBucketPolicy && (aws.ToBool(settings.BlockPublicPolicy) || aws.ToBool(settings.RestrictPublicBuckets)) {
+			return fmt.Errorf("bucket %s blocks public bucket policies", store.bucket)
+		}
+	}
+
+	if access != objectAccessPublicRead {
+		return nil
+	}
+	ownership, err := store.client.GetBucketOwnershipControls(ctx, &s3.GetBucketOwnershipControlsInput{
+		Bucket: aws.String(store.bucket),
+	})
+	switch {
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "OwnershipControlsNotFoundError":
+	case err != nil:
+		log.Printf("Couldn't check object ownership for %s: %v", store.bucket, err)
+	default:
+		for _, rule := range ownership.OwnershipControls.Rules {
+			if rule.ObjectOwnership == types.ObjectOwnershipBucketOwnerEnforced {
+				return fmt.Errorf("bucket %s has ACLs disabled, use %s instead", store.bucket, objectAccessBucketPolicy)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// fakeS3 records the requests made to it and answers them with handle
+type fakeS3 struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	handle   func(w http.ResponseWriter, r *http.Request)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	f.mu.Unlock()
+	f.handle(w, r)
+}
+
+// count returns how many requests matched
+func (f *fakeS3) count(match func(r *http.Request) bool) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if match(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// newTestS3Store returns a store backed by handle, with the SDK's own
+// retries turned off
+func newTestS3Store(t *testing.T, handle func(w http.ResponseWriter, r *http.Request)) (*s3Store, *fakeS3) {
+	fake := &fakeS3{handle: handle}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		UsePathStyle:     true,
+		Credentials:      credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		RetryMaxAttempts: 1,
+	})
+	return &s3Store{
+		region:        "us-east-1",
+		bucket:        "tubely-test",
+		client:        client,
+		presignClient: s3.NewPresignClient(client),
+		distribution:  "https://cdn.example.com/",
+	}, fake
+}
+
+// memoryS3 is a bucket held in memory, enough of S3 for objects to be put,
+// read, copied, listed and deleted
+type memoryS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemoryS3() *memoryS3 {
+	return &memoryS3{objects: map[string][]byte{}}
+}
+
+// keys returns the stored keys under prefix, sorted
+func (m *memoryS3) keys(prefix string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := []string{}
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (m *memoryS3) handle(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// path style, so the path is /bucket/key
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		type object struct {
+			Key          string
+			Size         int
+			LastModified string
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			IsTruncated bool
+			Contents    []object
+		}{}
+		for stored, data := range m.objects {
+			if strings.HasPrefix(stored, query.Get("prefix")) {
+				result.Contents = append(result.Contents, object{stored, len(data), "2026-01-01T00:00:00.000Z"})
+			}
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPost && query.Has("delete"):
+		var request struct {
+			Objects []struct{ Key string } `xml:"Object"`
+		}
+		xml.NewDecoder(r.Body).Decode(&request)
+		for _, object := range request.Objects {
+			delete(m.objects, object.Key)
+		}
+		w.Write([]byte(`<DeleteResult></DeleteResult>`))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+		data, ok := m.objects[sourceKey]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		m.objects[key] = bytes.Clone(data)
+		w.Write([]byte(`<CopyObjectResult></CopyObjectResult>`))
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		m.objects[key] = data
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		data, ok := m.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(m.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func newTestS3Config() *apiConfig {
+	return &apiConfig{
+		s3PartSize:    5 * 1024 * 1024,
+		s3Concurrency: 1,
+		s3Timeout:     10 * time.Second,
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, attempt := range []int{0, 1, 5, 6, 7, 35, 40, 64, 1000} {
+		for range 100 {
+			delay := retryDelay(attempt)
+			if delay <= 0 || delay > 20*time.Second+time.Millisecond {
+				t.Fatalf("retryDelay(%d) = %v, want within (0, 20s]", attempt, delay)
+			}
+		}
+	}
+}
+
+func TestUploadAbortsFailedMultipartUpload(t *testing.T) {
+	store, fake := newTestS3Store(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			w.Write([]byte(`<InitiateMultipartUploadResult><Bucket>tubely-test</Bucket><Key>videos/a</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`))
+		case r.Method == http.MethodPut && query.Has("partNumber"):
+			// fail the upload part way through, with an error that isn't retried
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<Error><Code>AccessDenied</Code><Message>denied</Message></Error>`))
+		case r.Method == http.MethodDelete && query.Get("uploadId") == "upload-1":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	cfg := newTestS3Config()
+
+	// bigger than a part, so the uploader goes multipart
+	body := bytes.NewReader(make([]byte, cfg.s3PartSize+1))
+	err := cfg.uploadToS3Multipart(context.Background(), store, "videos/a", body, "video/mp4", "")
+	if err == nil {
+		t.Fatal("upload succeeded, want an error")
+	}
+
+	aborts := fake.count(func(r *http.Request) bool {
+		return r.Method == http.MethodDelete && r.URL.Query().Get("uploadId") == "upload-1"
+	})
+	if aborts != 1 {
+		t.Errorf("got %d aborts of the failed upload, want 1", aborts)
+	}
+}
+
+func TestAbortStaleMultipartUploadsStaysInKeyPrefix(t *testing.T) {
+	store, fake := newTestS3Store(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Query().Has("uploads") {
+			w.Write([]byte(`<ListMultipartUploadsResult><Bucket>tubely-test</Bucket><IsTruncated>false</IsTruncated></ListMultipartUploadsResult>`))
+			return
+		}
+		t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	cfg := newTestS3Config()
+	cfg.keyPrefix = "staging/"
+
+	_, err := cfg.abortStaleMultipartUploads(context.Background(), store, time.Hour)
+	if err != nil {
+		t.Fatalf("abortStaleMultipartUploads: %v", err)
+	}
+
+	listed := fake.count(func(r *http.Request) bool {
+		return r.URL.Query().Get("prefix") == "staging/"
+	})
+	if listed != 1 {
+		t.Errorf("uploads weren't listed under the key prefix")
+	}
+}
+
+func TestUploadWithCancelledContext(t *testing.T) {
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		wantStatus int
+	}{
+		{"deadline passed", expired, http.StatusGatewayTimeout},
+		{"cancelled", cancelled, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, fake := newTestS3Store(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			cfg := newTestS3Config()
+
+			s3Ctx, cancel := cfg.s3Context(tt.ctx)
+			defer cancel()
+			if s3Ctx.Err() == nil {
+				t.Fatal("s3Context isn't done, want it to inherit the parent's cancellation")
+			}
+
+			err := cfg.uploadToS3Multipart(tt.ctx, store, "videos/a", bytes.NewReader([]byte("video")), "video/mp4", "")
+			if err == nil {
+				t.Fatal("upload succeeded, want an error")
+			}
+			if status := s3ErrorStatus(err); status != tt.wantStatus {
+				t.Errorf("s3ErrorStatus(%v) = %d, want %d", err, status, tt.wantStatus)
+			}
+			if n := fake.count(func(*http.Request) bool { return true }); n != 0 {
+				t.Errorf("S3 got %d requests, want none", n)
+			}
+		})
+	}
+}
+
+func TestDeleteVideoObjectsRemovesHLSDirectory(t *testing.T) {
+	cfg, bucket := newTestConfig(t)
+	video, _ := createTestVideo(t, cfg)
+	other, _ := createTestVideo(t, cfg)
+
+	for _, v := range []*database.Video{&video, &other} {
+		dir := "hls/" + v.ID.String() + "/"
+		for _, key := range []string{dir + "master.m3u8", dir + "720p/playlist.m3u8", dir + "720p/segment0.ts"} {
+			bucket.objects[key] = []byte("hls")
+		}
+		hlsURL := cfg.defaultStore.distribution + dir + "master.m3u8"
+		v.HLSURL = &hlsURL
+	}
+
+	err := cfg.deleteVideoObjects(context.Background(), []database.Video{video})
+	if err != nil {
+		t.Fatalf("deleteVideoObjects: %v", err)
+	}
+	if keys := bucket.keys("hls/" + video.ID.String() + "/"); len(keys) != 0 {
+		t.Errorf("deleted video's HLS objects %v were left behind", keys)
+	}
+	if keys := bucket.keys("hls/" + other.ID.String() + "/"); len(keys) != 3 {
+		t.Errorf("other video's HLS objects = %v, want all 3 kept", keys)
+	}
+}
+
+func TestDeleteVideoObjectsWaitsForRunSavingSharedFile(t *testing.T) {
+	cfg, bucket := newTestConfig(t)
+	deleted, _ := createTestVideo(t, cfg)
+	saving, _ := createTestVideo(t, cfg)
+
+	key := "landscape/abc123"
+	bucket.objects[key] = []byte("video")
+	url := cfg.defaultStore.distribution + key
+	deleted.VideoURL = &url
+
+	// a processing run has found the file and hasn't saved its video yet
+	unlock := cfg.lockVideoObject(cfg.defaultStore, key)
+	done := make(chan error)
+	go func() {
+		done <- cfg.deleteVideoObjects(context.Background(), []database.Video{deleted})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("deleteVideoObjects returned %v while the file was locked, want it to wait", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	saving.VideoURL = &url
+	if err := cfg.db.UpdateVideo(saving); err != nil {
+		t.Fatalf("UpdateVideo: %v", err)
+	}
+	unlock()
+
+	if err := <-done; err != nil {
+		t.Fatalf("deleteVideoObjects: %v", err)
+	}
+	if keys := bucket.keys(key); len(keys) != 1 {
+		t.Errorf("shared file was deleted while the saving video points at it")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// signURL returns a CloudFront signed URL for urls served through our
+// distribution. When signing isn't configured, or the URL isn't one of
+// ours, it's returned unchanged with a zero expiry.
+//
+// Unlike an S3 presigned URL, the signature doesn't cover the method or
+// headers, so the same URL serves HEAD, Range and conditional requests as
+// long as the distribution allows HEAD, which it does by default.
+func (cfg *apiConfig) signURL(url string) (string, time.Time, error) {
+	if cfg.cfSigner == nil {
+		return url, time.Time{}, nil
+	}
+	if _, ok := cfg.objectKeyFromURL(&url); !ok {
+		return url, time.Time{}, nil
+	}
+
+	now := time.Now().UTC()
+	if signedURL, expiresAt, ok := cfg.urlCache.get(url, now); ok {
+		return signedURL, expiresAt, nil
+	}
+
+	expiresAt := now.Add(cfg.signedURLExpiry)
+	signedURL, err := cfg.cfSigner.Sign(url, expiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// reused for half its life, like videoETag's window, so every URL
+	// handed out has at least half the expiry left
+	cfg.urlCache.put(url, signedURL, expiresAt, now.Add(cfg.signedURLExpiry/2))
+	return signedURL, expiresAt, nil
+}
+
+func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
+	if video.ProcessingStatus == database.VideoStatusRejected {
+		return withoutURLs(video), nil
+	}
+
+	// The HLS playlist and sprite index signatures don't extend to the files
+	// they reference, so private distributions need signed cookies for those
+	for _, url := range []**string{&video.VideoURL, &video.ThumbnailURL, &video.HLSURL, &video.SpriteURL, &video.SpriteIndexURL} {
+		if *url == nil {
+			continue
+		}
+		signedURL, _, err := cfg.signURL(**url)
+		if err != nil {
+			return database.Video{}, err
+		}
+		*url = &signedURL
+	}
+
+	// copy so the caller's map isn't rewritten underneath it
+	captions := make(database.StringMap, len(video.Captions))
+	for language, url := range video.Captions {
+		signedURL, _, err := cfg.signURL(url)
+		if err != nil {
+			return database.Video{}, err
+		}
+		captions[language] = signedURL
+	}
+	video.Captions = captions
+	return video, nil
+}
+
+// listedVideo is a video in a list response. SigningError is set, and the
+// URLs left out, when the video's URLs couldn't be signed, so one failure
+// doesn't fail the whole list.
+type listedVideo struct {
+	database.Video
+	SigningError string `json:"signing_error,omitempty"`
+}
+
+// dbVideosToSignedVideos signs a list of videos across a bounded set of
+// workers. Videos that fail to sign are logged and returned without URLs.
+func (cfg *apiConfig) dbVideosToSignedVideos(videos []database.Video) []listedVideo {
+	listed := make([]listedVideo, len(videos))
+	if cfg.cfSigner == nil {
+		for i, video := range videos {
+			if video.ProcessingStatus == database.VideoStatusRejected {
+				video = withoutURLs(video)
+			}
+			listed[i] = listedVideo{Video: video}
+		}
+		return listed
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(runtime.NumCPU(), len(videos)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				video, err := cfg.dbVideoToSignedVideo(videos[i])
+				if err != nil {
+					log.Printf("Couldn't sign URLs for video %s: %v", videos[i].ID, err)
+					listed[i] = listedVideo{
+						Video:        withoutURLs(videos[i]),
+						SigningError: "Couldn't sign video URLs",
+					}
+					continue
+				}
+				listed[i] = listedVideo{Video: video}
+			}
+		}()
+	}
+	for i := range videos {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return listed
+}
+
+// withoutURLs clears every URL on video, for videos that can't be signed or
+// mustn't be served
+func withoutURLs(video database.Video) database.Video {
+	video.VideoURL = nil
+	video.ThumbnailURL = nil
+	video.HLSURL = nil
+	video.SpriteURL = nil
+	video.SpriteIndexURL = nil
+	video.Captions = database.StringMap{}
+	return video
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	spriteColumns    = 10
+	spriteMaxFrames  = 100
+	spriteFrameWidth = 160
+	// frames closer together than this add size without helping scrubbing
+	spriteMinInterval = 1.0
+)
+
+// spriteLayout describes how preview frames are tiled into the sprite sheet
+type spriteLayout struct {
+	interval float64
+	frames   int
+	columns  int
+	rows     int
+	width    int
+	height   int
+}
+
+func planSprite(videoInfo videoMetadata) spriteLayout {
+	interval := math.Max(videoInfo.DurationSeconds/spriteMaxFrames, spriteMinInterval)
+	frames := max(int(math.Ceil(videoInfo.DurationSeconds/interval)), 1)
+	columns := min(frames, spriteColumns)
+
+	height := spriteFrameWidth * 9 / 16
+	if videoInfo.Width > 0 && videoInfo.Height > 0 {
+		height = spriteFrameWidth * videoInfo.Height / videoInfo.Width
+	}
+	// ffmpeg's scaler wants even dimensions
+	height += height % 2
+
+	return spriteLayout{
+		interval: interval,
+		frames:   frames,
+		columns:  columns,
+		rows:     (frames + columns - 1) / columns,
+		width:    spriteFrameWidth,
+		height:   height,
+	}
+}
+
+func generateSpriteSheet(ctx context.Context, videoPath string, layout spriteLayout) (string, error) {
+	outputPath := videoPath + ".sprite.jpg"
+
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d,tile=%dx%d", formatSeconds(layout.interval), layout.width, layout.height, layout.columns, layout.rows)
+	command := execCommand(ctx, "ffmpeg", "-i", videoPath, "-vf", filter, "-frames:v", "1", "-q:v", "4", "-f", "image2", outputPath)
+	slog.DebugContext(ctx, "Running ffmpeg", "command", command.String())
+	err := command.Run()
+	if err != nil {
+		os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+
+	return outputPath, nil
+}
+
+// buildSpriteIndex renders a WebVTT track whose cues point at each frame's
+// region of the sprite using media fragments, which is what most players
+// expect for thumbnail previews. spriteURL is resolved against the track's
+// own URL, so a bare filename works when both sit next to each other.
+func buildSpriteIndex(layout spriteLayout, duration float64, spriteURL string) string {
+	var index strings.Builder
+	index.WriteString("WEBVTT\n")
+	for i := range layout.frames {
+		start := float64(i) * layout.interval
+		end := math.Min(start+layout.interval, duration)
+		x := (i % layout.columns) * layout.width
+		y := (i / layout.columns) * layout.height
+		fmt.Fprintf(&index, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", formatVTTTimestamp(start), formatVTTTimestamp(end), spriteURL, x, y, layout.width, layout.height)
+	}
+	return index.String()
+}
+
+func formatVTTTimestamp(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Milliseconds()%1000)
+}
+
+func formatSeconds(seconds float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", seconds), "0"), ".")
+}
+
+// createSprite generates the scrubbing sprite and its index and uploads both
+// under keyBase, returning their distribution URLs
+func (cfg *apiConfig) createSprite(ctx context.Context, store *s3Store, videoPath string, videoInfo videoMetadata, keyBase string, storageClass types.StorageClass) (string, string, error) {
+	layout := planSprite(videoInfo)
+
+	release, err := cfg.acquireFFmpeg(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	start := time.Now()
+	spritePath, err := generateSpriteSheet(ctx, videoPath, layout)
+	release()
+	cfg.metrics.observeFFmpeg("sprite", start)
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(spritePath)
+
+	spriteFile, err := os.Open(spritePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer spriteFile.Close()
+
+	spriteKey := keyBase + ".jpg"
+	err = cfg.uploadToS3Multipart(ctx, store, spriteKey, spriteFile, "image/jpeg", storageClass)
+	if err != nil {
+		return "", "", err
+	}
+
+	indexKey := keyBase + ".vtt"
+	index := buildSpriteIndex(layout, videoInfo.DurationSeconds, path.Base(spriteKey))
+	err = cfg.uploadToS3Multipart(ctx, store, indexKey, strings.NewReader(index), "text/vtt", storageClass)
+	if err != nil {
+		return "", "", err
+	}
+
+	return store.distribution + spriteKey, store.distribution + indexKey, nil
+}
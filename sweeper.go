@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// sweptPrefixes are the prefixes, under the key prefix, of every object we
+// write. Objects anywhere else in the bucket are never touched. The default
+// video folders are always included, since videos stored before the folders
+// were renamed keep their keys.
+func (cfg *apiConfig) sweptPrefixes() []string {
+	folders := slices.Concat(reservedPrefixes, slices.Collect(maps.Values(defaultAspectPrefixes)), slices.Collect(maps.Values(cfg.aspectPrefixes)))
+	for _, height := range cfg.transcodeHeights {
+		folders = append(folders, fmt.Sprintf("%dp", height))
+	}
+	slices.Sort(folders)
+	prefixes := []string{}
+	for _, folder := range slices.Compact(folders) {
+		prefixes = append(prefixes, folder+"/")
+	}
+	return prefixes
+}
+
+// runOrphanSweeper periodically deletes S3 objects no video refers to. In a
+// dry run it only logs what it would delete.
+func (cfg *apiConfig) runOrphanSweeper(interval, grace time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		orphans, bytes, err := cfg.sweepOrphanedObjects(context.Background(), grace, dryRun)
+		if err != nil {
+			slog.Error("Couldn't sweep orphaned objects", "error", err)
+		}
+		if orphans == 0 {
+			continue
+		}
+		if dryRun {
+			slog.Info("Orphan sweep would delete objects, set ORPHAN_SWEEP_DELETE=true to delete them", "objects", orphans, "size", formatBytes(bytes))
+		} else {
+			slog.Info("Deleted orphaned objects", "objects", orphans, "size", formatBytes(bytes))
+		}
+	}
+}
+
+// sweepOrphanedObjects finds objects older than grace that no video, trashed
+// or not, refers to, and deletes them unless dryRun is set. The grace period
+// covers objects uploaded by processing that hasn't saved its video yet.
+func (cfg *apiConfig) sweepOrphanedObjects(ctx context.Context, grace time.Duration, dryRun bool) (int, int64, error) {
+	// read the references first, so objects uploaded while listing are
+	// protected by the grace period rather than missing from the set
+	videos, err := cfg.db.GetVideosIncludingDeleted()
+	if err != nil {
+		return 0, 0, err
+	}
+	// keys are only unique within a bucket
+	referenced := map[*s3Store]map[string]bool{}
+	for _, store := range cfg.s3Stores {
+		referenced[store] = map[string]bool{}
+	}
+	hlsVideos := map[string]bool{}
+	for _, video := range videos {
+		store := cfg.videoStore(video)
+		for _, key := range cfg.videoObjectKeys(video) {
+			referenced[store][key] = true
+		}
+		if video.UploadKey != nil {
+			referenced[store][*video.UploadKey] = true
+		}
+		// playlists name their segments, so a video's whole HLS directory
+		// is kept while it has one
+		if video.HLSURL != nil {
+			hlsVideos[video.ID.String()] = true
+		}
+	}
+
+	cutoff := time.Now().Add(-grace)
+	orphanCount := 0
+	var orphanBytes int64
+	var errs []error
+	for _, store := range cfg.s3Stores {
+		orphans := []string{}
+		for _, prefix := range cfg.sweptPrefixes() {
+			paginator := s3.NewListObjectsV2Paginator(store.client, &s3.ListObjectsV2Input{
+				Bucket: aws.String(store.bucket),
+				Prefix: aws.String(cfg.keyPrefix + prefix),
+			})
+			for paginator.HasMorePages() {
+				pageCtx, cancel := cfg.s3Context(ctx)
+				page, err := paginator.NextPage(pageCtx)
+				cancel()
+				if err != nil {
+					return orphanCount, orphanBytes, errors.Join(append(errs, err)...)
+				}
+				for _, object := range page.Contents {
+					key := aws.ToString(object.Key)
+					if referenced[store][key] || object.LastModified == nil || object.LastModified.After(cutoff) {
+						continue
+					}
+					if rest, ok := strings.CutPrefix(key, cfg.keyPrefix+"hls/"); ok {
+						videoID, _, _ := strings.Cut(rest, "/")
+						if hlsVideos[videoID] {
+							continue
+						}
+					}
+					if dryRun {
+						slog.InfoContext(ctx, "Orphan sweep would delete object", "key", key, "bucket", store.bucket, "size", formatBytes(aws.ToInt64(object.Size)), "last_modified", object.LastModified.Format(time.RFC3339))
+					}
+					orphans = append(orphans, key)
+					orphanBytes += aws.ToInt64(object.Size)
+				}
+			}
+		}
+
+		orphanCount += len(orphans)
+		if !dryRun {
+			errs = append(errs, cfg.deleteS3Objects(ctx, store, orphans))
+		}
+	}
+	return orphanCount, orphanBytes, errors.Join(errs...)
+}
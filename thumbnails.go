@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// thumbnail dimensions outside these bounds are rejected at startup, since
+// ffmpeg allocates frames of whatever size it's asked for
+const (
+	minThumbnailDimension = 16
+	maxThumbnailDimension = 3840
+)
+
+// thumbnailOptions controls the size and format of generated thumbnails.
+// The frame is scaled down to fit within width by height, keeping its aspect
+// ratio; a zero dimension leaves that side unconstrained. Frames smaller
+// than the box aren't scaled up.
+type thumbnailOptions struct {
+	width  int
+	height int
+	// format is jpeg or webp
+	format string
+}
+
+func (o thumbnailOptions) validate() error {
+	if o.width == 0 && o.height == 0 {
+		return fmt.Errorf("at least one of width and height must be set")
+	}
+	for _, dimension := range []int{o.width, o.height} {
+		if dimension != 0 && (dimension < minThumbnailDimension || dimension > maxThumbnailDimension) {
+			return fmt.Errorf("dimensions must be between %d and %d, got %d", minThumbnailDimension, maxThumbnailDimension, dimension)
+		}
+	}
+	if o.format != "jpeg" && o.format != "webp" {
+		return fmt.Errorf("format must be jpeg or webp, got %q", o.format)
+	}
+	return nil
+}
+
+func (o thumbnailOptions) extension() string {
+	if o.format == "webp" {
+		return ".webp"
+	}
+	return ".jpg"
+}
+
+func (o thumbnailOptions) contentType() string {
+	if o.format == "webp" {
+		return "image/webp"
+	}
+	return "image/jpeg"
+}
+
+func (o thumbnailOptions) scaleFilter() string {
+	switch {
+	case o.height == 0:
+		return fmt.Sprintf("scale='min(%d,iw)':-1", o.width)
+	case o.width == 0:
+		return fmt.Sprintf("scale=-1:'min(%d,ih)'", o.height)
+	}
+	return fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", o.width, o.height)
+}
+
+func generateThumbnail(ctx context.Context, videoPath string, atSeconds float64, options thumbnailOptions) (string, error) {
+	outputPath := videoPath + options.extension()
+
+	args := []string{"-ss", strconv.FormatFloat(atSeconds, 'f', 3, 64), "-i", videoPath, "-frames:v", "1", "-vf", options.scaleFilter()}
+	if options.format == "webp" {
+		args = append(args, "-c:v", "libwebp", "-quality", "80", "-f", "webp", outputPath)
+	} else {
+		args = append(args, "-q:v", "2", "-f", "image2", outputPath)
+	}
+	command := execCommand(ctx, "ffmpeg", args...)
+	slog.DebugContext(ctx, "Running ffmpeg", "command", command.String())
+	err := command.Run()
+	if err != nil {
+		os.Remove(outputPath)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+
+	return outputPath, nil
+}
+
+// storeThumbnail uploads body under the thumbnails prefix and makes it the
+// video's thumbnail, deleting the one it replaces
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, video database.Video, body io.ReadSeeker, extension, contentType string) (database.Video, error) {
+	randomBytes := make([]byte, 32)
+	rand.Read(randomBytes)
+	store := cfg.videoStore(video)
+	thumbnailKey := cfg.keyPrefix + "thumbnails/" + base64.RawURLEncoding.EncodeToString(randomBytes) + extension
+	err := cfg.uploadToS3Multipart(ctx, store, thumbnailKey, body, contentType, cfg.videoStorageClass(video))
+	if err != nil {
+		return video, err
+	}
+
+	current, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		cfg.deleteUnsavedObjects(ctx, video, "", []string{thumbnailKey}, nil)
+		return video, err
+	}
+	previous := current
+
+	thumbnailURL := store.distribution + thumbnailKey
+	current.ThumbnailURL = &thumbnailURL
+	err = cfg.db.UpdateVideo(current)
+	if err != nil {
+		cfg.deleteUnsavedObjects(ctx, video, "", []string{thumbnailKey}, nil)
+		return video, err
+	}
+
+	cfg.deleteReplacedObjects(ctx, previous, current)
+	if current.Archived {
+		err = cfg.copyS3Object(ctx, store, thumbnailKey, thumbnailKey, cfg.videoStorageClass(current))
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't archive thumbnail", "video_id", current.ID, "error", err)
+		}
+	}
+	return current, nil
+}
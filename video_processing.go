@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// processingError carries a message that's safe to show the uploader,
+// alongside the underlying error
+type processingError struct {
+	message string
+	err     error
+}
+
+func (e *processingError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return e.message + ": " + e.err.Error()
+}
+
+func (e *processingError) Unwrap() error {
+	return e.err
+}
+
+func newProcessingError(message string, err error) *processingError {
+	return &processingError{message: message, err: err}
+}
+
+// processVideoUpload runs the raw upload at rawPath through conversion,
+// faststart, transcoding and thumbnail generation, stores the results in S3
+// and saves the updated video along with the processing status moderation
+// settled on. The caller owns rawPath and removes it. If processing fails,
+// the objects it uploaded are deleted again.
+func (cfg *apiConfig) processVideoUpload(ctx context.Context, video database.Video, rawPath, mediaType string) (database.Video, error) {
+	processCtx, cancel := context.WithTimeout(ctx, cfg.processTimeout)
+	defer cancel()
+	store := cfg.videoStore(video)
+
+	// objects uploaded by this run, which nothing points to until the video
+	// is saved
+	var videoKey string
+	var uploaded, uploadedShared []string
+	saved := false
+	defer func() {
+		if !saved {
+			cfg.deleteUnsavedObjects(context.WithoutCancel(ctx), video, videoKey, uploaded, uploadedShared)
+		}
+	}()
+
+	sourcePath := rawPath
+	if mediaType != "video/mp4" {
+		release, err := cfg.acquireFFmpeg(processCtx)
+		if err != nil {
+			return video, newProcessingError("Couldn't start video conversion", err)
+		}
+		start := time.Now()
+		convertedPath, err := convertToMP4(processCtx, rawPath)
+		release()
+		cfg.metrics.observeFFmpeg("convert", start)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return video, newProcessingError("Video conversion timed out", err)
+		}
+		if err != nil {
+			return video, newProcessingError("Couldn't convert video to mp4", err)
+		}
+		defer os.Remove(convertedPath)
+		sourcePath = convertedPath
+	}
+
+	sourceInfo, err := getVideoMetadata(processCtx, sourcePath)
+	if err != nil {
+		return video, newProcessingError("Couldn't probe video metadata", err)
+	}
+
+	processedFilePath := sourcePath
+	if !isFastStart(sourcePath) || !cfg.codecs.allows(sourceInfo) {
+		release, err := cfg.acquireFFmpeg(processCtx)
+		if err != nil {
+			return video, newProcessingError("Couldn't start video processing", err)
+		}
+		start := time.Now()
+		fastStartPath, err := processVideoForFastStart(processCtx, sourcePath, cfg.codecs, cfg.ffmpegRetries)
+		release()
+		cfg.metrics.observeFFmpeg("faststart", start)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return video, newProcessingError("Video processing timed out", err)
+		}
+		if err != nil {
+			return video, newProcessingError("Couldn't process video: "+err.Error(), err)
+		}
+		defer os.Remove(fastStartPath)
+		processedFilePath = fastStartPath
+	}
+
+	processedFile, err := os.Open(processedFilePath)
+	if err != nil {
+		return video, newProcessingError("Couldn't open processed file", err)
+	}
+	defer processedFile.Close()
+
+	videoInfo, err := getVideoMetadata(processCtx, processedFilePath)
+	if err != nil {
+		return video, newProcessingError("Couldn't probe video metadata", err)
+	}
+	if videoInfo.DurationSeconds <= 0 {
+		return video, newProcessingError("Video has no duration", nil)
+	}
+
+	randomBytes := make([]byte, 32)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return video, newProcessingError("Couldn't generate video key", err)
+	}
+
+	randomString := base64.RawURLEncoding.EncodeToString(randomBytes)
+
+	// a re-upload without a retained original drops the previous one too
+	var originalURL *string
+	var originalSize int64
+	var originalChecksum string
+	if cfg.keepOriginals {
+		originalKey := cfg.keyPrefix + "originals/" + randomString + videoExtensions[mediaType]
+		originalSize, originalChecksum, err = cfg.uploadOriginal(ctx, store, originalKey, rawPath, mediaType, cfg.videoStorageClass(video))
+		if err != nil {
+			return video, newProcessingError("Couldn't upload original to S3", err)
+		}
+		uploaded = append(uploaded, originalKey)
+		url := store.distribution + originalKey
+		originalURL = &url
+	}
+
+	_, aspectRatio, err := getVideoAspectRatio(processCtx, processedFilePath)
+	if err != nil {
+		return video, newProcessingError("Couldn't get video ratio", err)
+	}
+
+	contentHash, err := hashFile(processedFilePath)
+	if err != nil {
+		return video, newProcessingError("Couldn't hash video", err)
+	}
+
+	// identical uploads map to the same key, so they share one S3 object
+	videoKey = cfg.keyPrefix + cfg.aspectPrefixes[aspectRatio] + "/" + contentHash
+
+	// from finding the file here until the video pointing at it is saved,
+	// nothing else may decide it's unused and delete it. The failure cleanup
+	// above runs after this is released and takes the lock itself.
+	unlockObject := sync.OnceFunc(cfg.lockVideoObject(store, videoKey))
+	defer unlockObject()
+
+	exists, err := cfg.s3ObjectExists(ctx, store, videoKey)
+	if err != nil {
+		return video, newProcessingError("Couldn't check for existing video", err)
+	}
+	if !exists {
+		err = cfg.uploadToS3WithChecksum(ctx, store, videoKey, processedFile, "video/mp4", cfg.videoStorageClass(video), contentHash)
+		if err != nil {
+			return video, newProcessingError("Couldn't upload video to S3", err)
+		}
+		uploadedShared = append(uploadedShared, videoKey)
+	}
+
+	video.Resolutions = database.IntList{videoInfo.Height}
+	for _, height := range cfg.transcodeHeights {
+		if height >= videoInfo.Height {
+			continue
+		}
+
+		exists, err := cfg.s3ObjectExists(ctx, store, renditionKey(videoKey, height))
+		if err != nil {
+			return video, newProcessingError("Couldn't check for existing rendition", err)
+		}
+		if exists {
+			video.Resolutions = append(video.Resolutions, height)
+			continue
+		}
+
+		release, err := cfg.acquireFFmpeg(processCtx)
+		if err != nil {
+			return video, newProcessingError("Couldn't start transcoding", err)
+		}
+		start := time.Now()
+		renditionPath, err := transcodeToHeight(processCtx, processedFilePath, height)
+		release()
+		cfg.metrics.observeFFmpeg("transcode", start)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return video, newProcessingError("Video transcoding timed out", err)
+		}
+		if err != nil {
+			return video, newProcessingError(fmt.Sprintf("Couldn't transcode video to %dp", height), err)
+		}
+		defer os.Remove(renditionPath)
+
+		renditionFile, err := os.Open(renditionPath)
+		if err != nil {
+			return video, newProcessingError("Couldn't open transcoded file", err)
+		}
+		defer renditionFile.Close()
+
+		err = cfg.uploadToS3Multipart(ctx, store, renditionKey(videoKey, height), renditionFile, "video/mp4", cfg.videoStorageClass(video))
+		if err != nil {
+			return video, newProcessingError("Couldn't upload transcoded video to S3", err)
+		}
+		uploadedShared = append(uploadedShared, renditionKey(videoKey, height))
+		video.Resolutions = append(video.Resolutions, height)
+	}
+
+	if cfg.hlsEnabled {
+		release, err := cfg.acquireFFmpeg(processCtx)
+		if err != nil {
+			return video, newProcessingError("Couldn't start HLS processing", err)
+		}
+		start := time.Now()
+		hlsDir, err := processVideoToHLS(processCtx, processedFilePath, cfg.tempDir, videoInfo)
+		release()
+		cfg.metrics.observeFFmpeg("hls", start)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return video, newProcessingError("HLS processing timed out", err)
+		}
+		if err != nil {
+			return video, newProcessingError("Couldn't process video to HLS", err)
+		}
+		defer os.RemoveAll(hlsDir)
+
+		playlistKey, err := cfg.uploadHLS(ctx, store, hlsDir, cfg.keyPrefix+"hls/"+video.ID.String()+"/", cfg.videoStorageClass(video))
+		if err != nil {
+			return video, newProcessingError("Couldn't upload HLS renditions to S3", err)
+		}
+		hlsURL := store.distribution + playlistKey
+		video.HLSURL = &hlsURL
+	}
+
+	// previews are a nice to have, so a failure here doesn't fail the upload
+	spriteURL, spriteIndexURL, err := cfg.createSprite(processCtx, store, processedFilePath, videoInfo, cfg.keyPrefix+"sprites/"+randomString, cfg.videoStorageClass(video))
+	if err != nil {
+		slog.WarnContext(ctx, "Couldn't create preview sprite", "video_id", video.ID, "error", err)
+	} else {
+		video.SpriteURL = &spriteURL
+		video.SpriteIndexURL = &spriteIndexURL
+		for _, url := range []*string{video.SpriteURL, video.SpriteIndexURL} {
+			if key, ok := cfg.objectKeyFromURL(url); ok {
+				uploaded = append(uploaded, key)
+			}
+		}
+	}
+
+	release, err := cfg.acquireFFmpeg(processCtx)
+	if err != nil {
+		return video, newProcessingError("Couldn't start thumbnail generation", err)
+	}
+	start := time.Now()
+	thumbnailPath, err := generateThumbnail(processCtx, processedFilePath, videoInfo.DurationSeconds/10, cfg.thumbnailOptions)
+	release()
+	cfg.metrics.observeFFmpeg("thumbnail", start)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return video, newProcessingError("Thumbnail generation timed out", err)
+	}
+	if err != nil {
+		return video, newProcessingError("Couldn't generate thumbnail", err)
+	}
+	defer os.Remove(thumbnailPath)
+
+	decision, err := cfg.moderation.Moderate(processCtx, video, thumbnailPath)
+	if err != nil {
+		// hold the video for review rather than publish it unchecked
+		slog.WarnContext(ctx, "Couldn't moderate video", "video_id", video.ID, "error", err)
+		decision = moderationFlag
+	}
+
+	thumbnailFile, err := os.Open(thumbnailPath)
+	if err != nil {
+		return video, newProcessingError("Couldn't open thumbnail", err)
+	}
+	defer thumbnailFile.Close()
+
+	thumbnailKey := cfg.keyPrefix + "thumbnails/" + randomString + cfg.thumbnailOptions.extension()
+	err = cfg.uploadToS3Multipart(ctx, store, thumbnailKey, thumbnailFile, cfg.thumbnailOptions.contentType(), cfg.videoStorageClass(video))
+	if err != nil {
+		return video, newProcessingError("Couldn't upload thumbnail to S3", err)
+	}
+	uploaded = append(uploaded, thumbnailKey)
+
+	// processing can take minutes, so pick up any edits made in the meantime
+	current, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		return video, newProcessingError("Couldn't get video", err)
+	}
+	previous := current
+	current.Resolutions = video.Resolutions
+	current.HLSURL = video.HLSURL
+	current.SpriteURL = video.SpriteURL
+	current.SpriteIndexURL = video.SpriteIndexURL
+
+	thumbnailURL := store.distribution + thumbnailKey
+	current.ThumbnailURL = &thumbnailURL
+
+	newURL := store.distribution + videoKey
+	current.VideoURL = &newURL
+	current.SizeBytes = videoInfo.SizeBytes
+	current.DurationSeconds = videoInfo.DurationSeconds
+	current.Codec = videoInfo.Codec
+	current.OriginalFilename = video.OriginalFilename
+	current.FastStart = true
+	current.ChecksumSHA256 = contentHash
+	current.OriginalURL = originalURL
+	current.OriginalSizeBytes = originalSize
+	current.OriginalChecksumSHA256 = originalChecksum
+	current.UploadKey = nil
+	current.ProcessingStatus = moderationStatus(decision)
+
+	// the new files and the status that publishes them land together
+	err = cfg.db.WithTx(func(tx database.Tx) error {
+		err := tx.UpdateVideo(current)
+		if err != nil {
+			return err
+		}
+		return tx.SetVideoProcessingStatus(current.ID, current.ProcessingStatus, "")
+	})
+	if err != nil {
+		return video, newProcessingError("Couldn't update video", err)
+	}
+	saved = true
+	unlockObject()
+
+	// only now that the new files are saved is it safe to drop the old ones
+	cfg.deleteReplacedObjects(ctx, previous, current)
+	cfg.archiveNewObjects(ctx, current)
+	return current, nil
+}
+
+// deleteUnsavedObjects removes the objects a failed processing run uploaded.
+// Only keys the run uploaded itself are passed in. The video file and
+// renditions are kept if another video has since been saved with the same
+// content, and no run can be between finding them and saving while they're
+// checked.
+func (cfg *apiConfig) deleteUnsavedObjects(ctx context.Context, video database.Video, videoKey string, keys, sharedKeys []string) {
+	store := cfg.videoStore(video)
+	if len(sharedKeys) > 0 {
+		unlock := cfg.lockVideoObject(store, videoKey)
+		references, err := cfg.db.CountVideosByVideoURL(store.distribution + videoKey)
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't check references for unsaved video", "video_id", video.ID, "error", err)
+		} else if references == 0 {
+			cfg.deleteUnsavedKeys(ctx, video, store, sharedKeys)
+		}
+		unlock()
+	}
+	cfg.deleteUnsavedKeys(ctx, video, store, keys)
+}
+
+// deleteUnsavedKeys deletes keys one at a time, logging any failures
+func (cfg *apiConfig) deleteUnsavedKeys(ctx context.Context, video database.Video, store *s3Store, keys []string) {
+	for _, key := range keys {
+		err := cfg.deleteS3Object(ctx, store, key)
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't delete unsaved object", "video_id", video.ID, "key", key, "error", err)
+		}
+	}
+}
+
+// archiveNewObjects moves the objects just uploaded for an archived video
+// into the archive storage class. Failures are only logged since the objects
+// can still be served, they just cost more.
+func (cfg *apiConfig) archiveNewObjects(ctx context.Context, video database.Video) {
+	if !video.Archived {
+		return
+	}
+	err := cfg.applyVideoStorageClass(ctx, video)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't archive new objects", "video_id", video.ID, "error", err)
+	}
+}
+
+// deleteReplacedObjects removes the S3 objects a re-upload left unused.
+// Failures are only logged since the video itself is already updated.
+func (cfg *apiConfig) deleteReplacedObjects(ctx context.Context, previous, current database.Video) {
+	keep := map[string]bool{}
+	for _, key := range cfg.videoObjectKeys(current) {
+		keep[key] = true
+	}
+
+	// uploads are deduplicated, so another video may still share the old
+	// file, or a run may be about to save one that does
+	keys := cfg.perVideoObjectKeys(previous)
+	if videoKey, ok := cfg.objectKeyFromURL(previous.VideoURL); ok {
+		unlock := cfg.lockVideoObject(cfg.videoStore(previous), videoKey)
+		defer unlock()
+		references, err := cfg.db.CountVideosByVideoURL(*previous.VideoURL)
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't check references for replaced video", "video_id", previous.ID, "error", err)
+			return
+		}
+		if references == 0 {
+			keys = append(keys, cfg.sharedObjectKeys(previous)...)
+		}
+	}
+
+	for _, key := range keys {
+		if keep[key] {
+			continue
+		}
+		err := cfg.deleteS3Object(ctx, cfg.videoStore(previous), key)
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't delete replaced object", "video_id", previous.ID, "key", key, "error", err)
+		}
+	}
+}
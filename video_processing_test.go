@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestUpload writes a raw upload that sniffs as an MP4 but isn't
+// faststart, so processing runs it through ffmpeg
+func writeTestUpload(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "tubely-upload-test.mp4")
+	err := os.WriteFile(path, testMP4(minUploadBytes), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// stubProcessing stands in for ffprobe, reporting probe for every file, and
+// for ffmpeg, writing the same output for every run
+func stubProcessing(t *testing.T, probe string) {
+	t.Helper()
+	stubCommands(t, func(name string, args []string) fakeCommand {
+		if name == "ffprobe" {
+			return fakeCommand{stdout: probe}
+		}
+		return fakeCommand{output: "processed", outputPath: args[len(args)-1]}
+	})
+}
+
+func TestProcessVideoUploadRejectsZeroDuration(t *testing.T) {
+	cfg, bucket := newTestConfig(t)
+	video, _ := createTestVideo(t, cfg)
+	stubProcessing(t, probeOutput("h264", 1920, 1080, "aac", 0))
+
+	_, err := cfg.processVideoUpload(context.Background(), video, writeTestUpload(t, cfg.tempDir), "video/mp4")
+	var procErr *processingError
+	if !errors.As(err, &procErr) || procErr.message != "Video has no duration" {
+		t.Fatalf("processVideoUpload error = %v, want no duration", err)
+	}
+	if keys := bucket.keys(""); len(keys) != 0 {
+		t.Errorf("bucket holds %v, want nothing stored", keys)
+	}
+}
+
+func TestProcessVideoUploadDeduplicatesIdenticalUploads(t *testing.T) {
+	cfg, bucket := newTestConfig(t)
+	stubProcessing(t, probeOutput("h264", 1920, 1080, "aac", 10))
+
+	urls := []string{}
+	for range 2 {
+		video, _ := createTestVideo(t, cfg)
+		processed, err := cfg.processVideoUpload(context.Background(), video, writeTestUpload(t, cfg.tempDir), "video/mp4")
+		if err != nil {
+			t.Fatalf("processVideoUpload: %v", err)
+		}
+		urls = append(urls, *processed.VideoURL)
+	}
+
+	if urls[0] != urls[1] {
+		t.Errorf("videos point at %v, want the same object", urls)
+	}
+	if keys := bucket.keys("landscape/"); len(keys) != 1 {
+		t.Errorf("bucket holds videos %v, want a single object", keys)
+	}
+}
+
+func TestProcessVideoUploadRemovesUnopenableProcessedFile(t *testing.T) {
+	cfg, bucket := newTestConfig(t)
+	video, _ := createTestVideo(t, cfg)
+	stubCommands(t, func(name string, args []string) fakeCommand {
+		if name == "ffprobe" {
+			return fakeCommand{stdout: probeOutput("h264", 1920, 1080, "aac", 10)}
+		}
+		return fakeCommand{outputPath: args[len(args)-1], danglingOutput: true}
+	})
+	rawPath := writeTestUpload(t, cfg.tempDir)
+
+	_, err := cfg.processVideoUpload(context.Background(), video, rawPath, "video/mp4")
+	var procErr *processingError
+	if !errors.As(err, &procErr) || procErr.message != "Couldn't open processed file" {
+		t.Fatalf("processVideoUpload error = %v, want the processed file failing to open", err)
+	}
+
+	// the raw upload belongs to the caller, everything else should be gone
+	entries, err := os.ReadDir(cfg.tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if filepath.Join(cfg.tempDir, entry.Name()) != rawPath {
+			t.Errorf("%s was left in the temp dir", entry.Name())
+		}
+	}
+	if keys := bucket.keys(""); len(keys) != 0 {
+		t.Errorf("bucket holds %v, want nothing stored", keys)
+	}
+}
+
+func TestProcessVideoUploadUsesProcessedFileAspectRatio(t *testing.T) {
+	cfg, bucket := newTestConfig(t)
+	video, _ := createTestVideo(t, cfg)
+	// the raw upload looks landscape, but the processed file, which is what's
+	// stored, is portrait
+	stubCommands(t, func(name string, args []string) fakeCommand {
+		if name == "ffprobe" {
+			if strings.HasSuffix(args[len(args)-1], ".processing") {
+				return fakeCommand{stdout: probeOutput("h264", 1080, 1920, "aac", 10)}
+			}
+			return fakeCommand{stdout: probeOutput("h264", 1920, 1080, "aac", 10)}
+		}
+		return fakeCommand{output: "processed", outputPath: args[len(args)-1]}
+	})
+
+	processed, err := cfg.processVideoUpload(context.Background(), video, writeTestUpload(t, cfg.tempDir), "video/mp4")
+	if err != nil {
+		t.Fatalf("processVideoUpload: %v", err)
+	}
+	key, _ := cfg.objectKeyFromURL(processed.VideoURL)
+	if !strings.HasPrefix(key, "portrait/") {
+		t.Errorf("video stored at %q, want it under portrait/", key)
+	}
+	if keys := bucket.keys("portrait/"); len(keys) != 1 {
+		t.Errorf("bucket holds portrait videos %v, want one", keys)
+	}
+}
+
+func TestProcessVideoUploadTimesOutEveryStep(t *testing.T) {
+	tests := []struct {
+		name string
+		hang func(name string, args []string) bool
+	}{
+		{"probing the processed file", func(name string, args []string) bool {
+			return name == "ffprobe" && strings.HasSuffix(args[len(args)-1], ".processing")
+		}},
+		{"generating the thumbnail", func(name string, args []string) bool {
+			return name == "ffmpeg" && args[0] == "-ss"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			cfg.processTimeout = 2 * time.Second
+			video, _ := createTestVideo(t, cfg)
+			stubCommands(t, func(name string, args []string) fakeCommand {
+				fake := fakeCommand{output: "processed", outputPath: args[len(args)-1]}
+				if name == "ffprobe" {
+					fake = fakeCommand{stdout: probeOutput("h264", 1920, 1080, "aac", 10)}
+				}
+				if tt.hang(name, args) {
+					fake.sleep = time.Minute
+				}
+				return fake
+			})
+
+			start := time.Now()
+			_, err := cfg.processVideoUpload(context.Background(), video, writeTestUpload(t, cfg.tempDir), "video/mp4")
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("processVideoUpload error = %v, want %v", err, context.DeadlineExceeded)
+			}
+			if elapsed := time.Since(start); elapsed > 20*time.Second {
+				t.Errorf("took %v, want it stopped by the %v timeout", elapsed, cfg.processTimeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the request body,
+// keyed with the webhook secret
+const webhookSignatureHeader = "X-Tubely-Signature"
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type webhookPayload struct {
+	VideoID         uuid.UUID `json:"video_id"`
+	Status          string    `json:"status"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// notifyProcessingDone delivers payload to the configured webhook in the
+// background so retries don't hold up the processing worker. It does nothing
+// when no webhook is configured.
+func (cfg *apiConfig) notifyProcessingDone(ctx context.Context, payload webhookPayload) {
+	if cfg.webhookURL == "" {
+		return
+	}
+
+	cfg.webhookPending.Add(1)
+	go func() {
+		defer cfg.webhookPending.Done()
+		err := cfg.sendWebhook(ctx, payload)
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't deliver webhook", "video_id", payload.VideoID, "status", payload.Status, "error", err)
+		}
+	}()
+}
+
+// sendWebhook posts payload, retrying with backoff until the receiver
+// answers with a 2xx or the retries run out
+func (cfg *apiConfig) sendWebhook(ctx context.Context, payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(cfg.webhookSecret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	for attempt := 0; ; attempt++ {
+		err = postWebhook(ctx, cfg.webhookURL, body, signature)
+		if err == nil || attempt >= cfg.webhookRetries {
+			return err
+		}
+
+		delay := retryDelay(attempt)
+		slog.WarnContext(ctx, "Retrying webhook", "video_id", payload.VideoID, "attempt", attempt+1, "delay", delay, "error", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func postWebhook(ctx context.Context, url string, body []byte, signature string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, signature)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so the connection can be reused
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}